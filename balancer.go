@@ -1,7 +1,10 @@
 package proxy
 
 import (
-	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
 )
 
 // IBalancer .
@@ -9,12 +12,70 @@ type IBalancer interface {
 	Distribute() int
 }
 
+// IFeedbackBalancer is an IBalancer which needs to know when the request
+// distributed by it has finished.
+type IFeedbackBalancer interface {
+	IBalancer
+
+	// Done is called once for each Distribute when the request distributed
+	// to idx has finished, elapsed is the time spent on the upstream and err
+	// is the error of request. elapsed is 0 if the upstream was not used.
+	Done(idx int, elapsed time.Duration, err error)
+}
+
+// IRequestBalancer is an IBalancer which distributes requests by the content
+// of request, such as consistent hashing by a header. Distribute is used if
+// the request is not available.
+type IRequestBalancer interface {
+	IBalancer
+
+	// DistributeRequest returns the idx of the choosing in ws ([]W) for ctx.
+	DistributeRequest(ctx *fasthttp.RequestCtx) int
+}
+
+// IUpdatableBalancer is an IBalancer whose weights could be changed at runtime.
+type IUpdatableBalancer interface {
+	IBalancer
+
+	// Update replaces the weights of balancer.
+	Update(ws []W)
+}
+
+// BalancerFactory constructs an IBalancer with weights of upstreams, the
+// returned index of Distribute is the index in ws.
+type BalancerFactory func(ws []W) IBalancer
+
 // W is an interface which should be implemented by the type
 // which will be used in balancer.
 type W interface {
 	Weight() int
 }
 
+// InflightW is a W which knows the number of its in-flight requests, such as
+// the upstreams of ReverseProxy. The balancers read the loads from it instead
+// of counting by themselves, so that the loads are kept when the balancer is
+// rebuilt with the same upstreams.
+type InflightW interface {
+	W
+
+	// Inflight returns the number of requests being processed.
+	Inflight() int64
+}
+
+// inflightWs returns ws as InflightW, nil if any of them is not.
+func inflightWs(ws []W) []InflightW {
+	live := make([]InflightW, 0, len(ws))
+	for _, w := range ws {
+		iw, ok := w.(InflightW)
+		if !ok {
+			return nil
+		}
+		live = append(live, iw)
+	}
+
+	return live
+}
+
 // Weight .
 type Weight uint
 
@@ -22,69 +83,163 @@ func (w Weight) Weight() int {
 	return int(w)
 }
 
-// NewBalancer constructs a IBalancer instance which implements roundrobin algorithm.
+const (
+	// _maxScheduleLen caps the length of schedule of roundRobinBalancer, weights
+	// are scaled down proportionally if the sum of them exceeds it.
+	_maxScheduleLen = 1 << 16
+	// _maxScheduleWork caps the work to compute a schedule, which is the length
+	// of schedule times the number of distinct weights, since it's computed with
+	// the lock of ReverseProxy held.
+	_maxScheduleWork = 1 << 18
+)
+
+// NewBalancer constructs a IBalancer instance which implements smooth weighted
+// round-robin algorithm (nginx-style), its Distribute is lock-free.
 func NewBalancer(ws []W) IBalancer {
-	rrb := roundRobinBalancer{
-		// choices:      ws,
-		mutex:        sync.Mutex{},
-		weights:      make([]int, len(ws)),
-		maxWeight:    0,
-		maxGCD:       1,
-		lenOfWeights: len(ws),
-		i:            -1,
-		cw:           0,
+	rrb := &roundRobinBalancer{}
+	rrb.Update(ws)
+
+	return rrb
+}
+
+// roundRobinBalancer is a smooth weighted round-robin balancer. The sequence
+// of choices of smooth weighted round-robin is periodic, so it's precomputed
+// as schedule, and Distribute just takes the next one from schedule with an
+// atomic counter.
+type roundRobinBalancer struct {
+	schedule atomic.Pointer[[]int]
+	counter  atomic.Uint64
+}
+
+// Update replaces the weights of balancer, it's safe to be called concurrently
+// with Distribute.
+func (rrb *roundRobinBalancer) Update(ws []W) {
+	schedule := smoothSchedule(ws)
+	rrb.schedule.Store(&schedule)
+}
+
+// Distribute to implement round-robin algorithm, returns the idx of the choosing in ws ([]W)
+func (rrb *roundRobinBalancer) Distribute() int {
+	schedule := *rrb.schedule.Load()
+	if len(schedule) == 0 {
+		return 0
 	}
 
-	tmpGCD := make([]int, 0, rrb.lenOfWeights)
+	n := rrb.counter.Add(1) - 1
+	return schedule[n%uint64(len(schedule))]
+}
 
+// smoothSchedule computes a period of choices of smooth weighted round-robin.
+// The weights are reduced by their GCD, and scaled down proportionally if the
+// sum of them exceeds _maxScheduleLen, or less if there are so many distinct
+// weights that the work would exceed _maxScheduleWork. Each positive weight
+// is chosen at least once.
+// ref to: https://github.com/phusion/nginx/commit/27e94984486058d73157038f7950a0a36ecc6e35
+func smoothSchedule(ws []W) []int {
+	if len(ws) == 0 {
+		return nil
+	}
+
+	weights := make([]int, len(ws))
+	total := 0
 	for idx, w := range ws {
-		rrb.weights[idx] = w.Weight()
-		if w.Weight() > rrb.maxWeight {
-			rrb.maxWeight = w.Weight()
+		if w.Weight() > 0 {
+			weights[idx] = w.Weight()
+			total += weights[idx]
+		}
+	}
+
+	if total == 0 {
+		// all weights are zero, take them equally.
+		for idx := range weights {
+			weights[idx] = 1
+		}
+		total = len(weights)
+	}
+
+	// reduce the length of schedule.
+	if g := nGCD(weights, len(weights)); g > 1 {
+		total = 0
+		for idx := range weights {
+			weights[idx] /= g
+			total += weights[idx]
+		}
+	}
+
+	maxLen := _maxScheduleLen
+	if n := len(groupWeights(weights)); maxLen*n > _maxScheduleWork {
+		maxLen = max(_maxScheduleWork/n, len(weights))
+	}
+
+	if total > maxLen {
+		scaled := 0
+		for idx, w := range weights {
+			if w == 0 {
+				continue
+			}
+			weights[idx] = w * maxLen / total
+			if weights[idx] == 0 {
+				weights[idx] = 1
+			}
+			scaled += weights[idx]
 		}
-		tmpGCD = append(tmpGCD, w.Weight())
+		total = scaled
 	}
 
-	rrb.maxGCD = nGCD(tmpGCD, rrb.lenOfWeights)
+	// the upstream with the biggest current weight, which is i*weight minus
+	// total*picks in round i, is chosen. The upstreams with the same weight
+	// are chosen in the order of index, since they gain the same weight and
+	// the lowest index wins the tie, so that the current weights are computed
+	// for each group instead of each upstream.
+	groups := groupWeights(weights)
+	schedule := make([]int, 0, total)
+	for i := 1; i <= total; i++ {
+		var best *weightGroup
+		bestCurrent, bestIdx := 0, 0
+		for _, g := range groups {
+			n := len(g.members)
+			current := i*g.weight - total*(g.picks/n)
+			idx := g.members[g.picks%n]
+			if best == nil || current > bestCurrent || (current == bestCurrent && idx < bestIdx) {
+				best, bestCurrent, bestIdx = g, current, idx
+			}
+		}
+
+		best.picks++
+		schedule = append(schedule, bestIdx)
+	}
 
-	return &rrb
+	return schedule
 }
 
-// roundRobinBalancer is a uniform-distributed balancer.
-type roundRobinBalancer struct {
-	// choices      []W
-	mutex        sync.Mutex
-	weights      []int // weight
-	maxWeight    int   // 0
-	maxGCD       int   // 1
-	lenOfWeights int   // 0
-	i            int   // last choice, -1
-	cw           int   // current weight, 0
+// weightGroup is the upstreams with the same positive weight.
+type weightGroup struct {
+	weight int
+	// members are the indexes of upstreams in ascending order.
+	members []int
+	// picks is the number of choices of the group.
+	picks int
 }
 
-// Distribute to implement round-robin algorithm, returns the idx of the choosing in ws ([]W)
-// TODO(@yeqown): changing to no lock call
-func (rrb *roundRobinBalancer) Distribute() int {
-	rrb.mutex.Lock()
-	defer rrb.mutex.Unlock()
-
-	for {
-		rrb.i = (rrb.i + 1) % rrb.lenOfWeights
-
-		if rrb.i == 0 {
-			rrb.cw = rrb.cw - rrb.maxGCD
-			if rrb.cw <= 0 {
-				rrb.cw = rrb.maxWeight
-				if rrb.cw == 0 {
-					return 0
-				}
-			}
+// groupWeights groups the positive weights, the zero ones are never chosen.
+func groupWeights(weights []int) []*weightGroup {
+	groups := make([]*weightGroup, 0, 4)
+	byWeight := make(map[int]*weightGroup, 4)
+	for idx, w := range weights {
+		if w <= 0 {
+			continue
 		}
 
-		if rrb.weights[rrb.i] >= rrb.cw {
-			return rrb.i
+		g, ok := byWeight[w]
+		if !ok {
+			g = &weightGroup{weight: w}
+			byWeight[w] = g
+			groups = append(groups, g)
 		}
+		g.members = append(g.members, idx)
 	}
+
+	return groups
 }
 
 // gcd calculates the GCD of a and b.
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// _hashReplicas is the average number of virtual nodes of each upstream on the ring.
+const _hashReplicas = 160
+
+// ConsistentHashBalancerFactory returns a BalancerFactory which constructs
+// IRequestBalancer instances implementing consistent hashing with virtual nodes.
+// Requests with the same key are distributed to the same upstream, and only
+// the keys of an upstream would be remapped when it's added or removed.
+// Requests without key are distributed in round-robin.
+//
+// The position of an upstream on the ring is decided by its identity, which is
+// the address of upstream (W implementing fmt.Stringer), or the index in ws.
+// The number of virtual nodes of each upstream is proportional to its weight.
+func ConsistentHashBalancerFactory(key KeyFunc) BalancerFactory {
+	return func(ws []W) IBalancer {
+		return newHashRing(ws, key, _hashReplicas)
+	}
+}
+
+// hashRing is a consistent hashing balancer.
+type hashRing struct {
+	key KeyFunc
+
+	// hashes of virtual nodes in ascending order, and the index of upstream
+	// which each virtual node belongs to.
+	hashes []uint64
+	owners []int
+
+	// choices are the indexes with positive weight, it's used by fallback round-robin.
+	choices []int
+	next    atomic.Uint64
+}
+
+func newHashRing(ws []W, key KeyFunc, replicas int) *hashRing {
+	ring := &hashRing{
+		key:     key,
+		choices: make([]int, 0, len(ws)),
+	}
+
+	total := 0
+	for idx, w := range ws {
+		if w.Weight() > 0 {
+			total += w.Weight()
+			ring.choices = append(ring.choices, idx)
+		}
+	}
+
+	if total == 0 {
+		// all weights are zero, take them equally.
+		ring.choices = ring.choices[:0]
+		for idx := range ws {
+			ring.choices = append(ring.choices, idx)
+		}
+		total = len(ws)
+	}
+
+	type vnode struct {
+		hash  uint64
+		owner int
+	}
+	vnodes := make([]vnode, 0, replicas*len(ring.choices))
+	for _, idx := range ring.choices {
+		weight := ws[idx].Weight()
+		if weight <= 0 {
+			weight = 1
+		}
+
+		n := replicas * len(ring.choices) * weight / total
+		if n < 1 {
+			n = 1
+		}
+
+		id := identity(ws[idx], idx)
+		for i := 0; i < n; i++ {
+			vnodes = append(vnodes, vnode{hash: hashKey([]byte(id + "#" + strconv.Itoa(i))), owner: idx})
+		}
+	}
+
+	sort.Slice(vnodes, func(i, j int) bool {
+		if vnodes[i].hash == vnodes[j].hash {
+			return vnodes[i].owner < vnodes[j].owner
+		}
+		return vnodes[i].hash < vnodes[j].hash
+	})
+
+	ring.hashes = make([]uint64, len(vnodes))
+	ring.owners = make([]int, len(vnodes))
+	for i, vn := range vnodes {
+		ring.hashes[i] = vn.hash
+		ring.owners[i] = vn.owner
+	}
+
+	return ring
+}
+
+// identity returns the stable identity of w.
+func identity(w W, idx int) string {
+	if s, ok := w.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return strconv.Itoa(idx)
+}
+
+// Distribute distributes in round-robin, since there is no key.
+func (ring *hashRing) Distribute() int {
+	if len(ring.choices) == 0 {
+		return 0
+	}
+
+	n := ring.next.Add(1) - 1
+	return ring.choices[n%uint64(len(ring.choices))]
+}
+
+// DistributeRequest implements IRequestBalancer.
+func (ring *hashRing) DistributeRequest(ctx *fasthttp.RequestCtx) int {
+	var key []byte
+	if ring.key != nil {
+		key = ring.key(ctx)
+	}
+
+	if len(key) == 0 || len(ring.hashes) == 0 {
+		return ring.Distribute()
+	}
+
+	return ring.lookup(hashKey(key))
+}
+
+// lookup finds the first virtual node clockwise from hash.
+func (ring *hashRing) lookup(hash uint64) int {
+	i := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	if i == len(ring.hashes) {
+		i = 0
+	}
+
+	return ring.owners[i]
+}
+
+// hashKey hashes key with FNV-1a, the result is mixed to be spread evenly on the ring.
+// It's stable across processes, so that multiple proxies would agree on the mapping.
+func hashKey(key []byte) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+
+	h := uint64(offset64)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= prime64
+	}
+
+	// finalizer of splitmix64
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+
+	return h
+}
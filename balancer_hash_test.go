@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// namedWeight is a W with identity.
+type namedWeight struct {
+	name   string
+	weight int
+}
+
+func (nw namedWeight) Weight() int    { return nw.weight }
+func (nw namedWeight) String() string { return nw.name }
+
+func newNamedWeights(names ...string) []W {
+	ws := make([]W, 0, len(names))
+	for _, name := range names {
+		ws = append(ws, namedWeight{name: name, weight: 1})
+	}
+	return ws
+}
+
+func Test_hashRing_remap(t *testing.T) {
+	names := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		names = append(names, "10.0.0."+strconv.Itoa(i)+":80")
+	}
+
+	before := newHashRing(newNamedWeights(names...), nil, _hashReplicas)
+	// remove the 4th upstream
+	after := newHashRing(newNamedWeights(append(names[:3:3], names[4:]...)...), nil, _hashReplicas)
+
+	const keys = 10000
+	moved := 0
+	for i := 0; i < keys; i++ {
+		hash := hashKey([]byte("key-" + strconv.Itoa(i)))
+		b := names[before.lookup(hash)]
+		a := append(names[:3:3], names[4:]...)[after.lookup(hash)]
+		if a != b {
+			moved++
+			assert.Equal(t, names[3], b, "only keys of removed upstream should be remapped")
+		}
+	}
+
+	// about 1/10 keys are moved.
+	assert.InDelta(t, keys/10, moved, keys/20)
+}
+
+func Test_hashRing_weights(t *testing.T) {
+	ring := newHashRing([]W{
+		namedWeight{name: "a", weight: 1},
+		namedWeight{name: "b", weight: 3},
+		namedWeight{name: "c", weight: 0},
+	}, nil, _hashReplicas)
+
+	count := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		count[ring.lookup(hashKey([]byte(strconv.Itoa(i))))]++
+	}
+
+	assert.Zero(t, count[2])
+	assert.InDelta(t, 3.0, float64(count[1])/float64(count[0]), 1.0)
+}
+
+func Test_hashRing_DistributeRequest(t *testing.T) {
+	ring := ConsistentHashBalancerFactory(HeaderKey("X-User"))(newNamedWeights("a", "b", "c")).(IRequestBalancer)
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	ctx.Request.Header.Set("X-User", "alice")
+	idx := ring.DistributeRequest(ctx)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, idx, ring.DistributeRequest(ctx))
+	}
+
+	// without key, round-robin is used.
+	ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	count := make(map[int]int)
+	for i := 0; i < 9; i++ {
+		count[ring.DistributeRequest(ctx)]++
+	}
+	assert.Equal(t, map[int]int{0: 3, 1: 3, 2: 3}, count)
+}
+
+func Test_KeyFunc(t *testing.T) {
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/?user=bob")
+	ctx.Request.Header.Set("X-Api-Key", "key")
+	ctx.Request.Header.SetCookie("session", "abc")
+
+	assert.Equal(t, "key", string(HeaderKey("X-Api-Key")(ctx)))
+	assert.Equal(t, "abc", string(CookieKey("session")(ctx)))
+	assert.Equal(t, "bob", string(QueryArgKey("user")(ctx)))
+	assert.Equal(t, "10.0.0.1", string(ClientIPKey(ctx)))
+	assert.Empty(t, HeaderKey("X-Missing")(ctx))
+
+	ctx.Init(&ctx.Request, &net.TCPAddr{}, nil)
+	assert.Empty(t, ClientIPKey(ctx))
+}
+
+func Test_ReverseProxy_WithConsistentHashBalancer(t *testing.T) {
+	weights := make(map[string]Weight)
+	for i := 0; i < 3; i++ {
+		name := strconv.Itoa(i)
+		weights[newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString(name) })] = 1
+	}
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(weights),
+		WithBalancerFactory(ConsistentHashBalancerFactory(QueryArgKey("user"))),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	serve := func(user string) string {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/?user="+user)
+		proxy.ServeHTTP(ctx)
+		return string(ctx.Response.Body())
+	}
+
+	for _, user := range []string{"alice", "bob", "carol", "dave"} {
+		first := serve(user)
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, first, serve(user))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// NewLeastConnBalancer constructs an IFeedbackBalancer instance which implements
+// weighted least-connections algorithm, the upstream with the least outstanding
+// requests relative to its weight is chosen. The in-flight requests are read
+// from ws if they're InflightW, otherwise they're counted by Distribute and Done.
+func NewLeastConnBalancer(ws []W) IBalancer {
+	lcb := &leastConnBalancer{
+		weights: make([]int64, len(ws)),
+		live:    inflightWs(ws),
+	}
+	if lcb.live == nil {
+		lcb.inflight = make([]atomic.Int64, len(ws))
+	}
+
+	for idx, w := range ws {
+		lcb.weights[idx] = int64(w.Weight())
+	}
+
+	return lcb
+}
+
+// leastConnBalancer is a weighted least-connections balancer.
+type leastConnBalancer struct {
+	weights []int64
+	// live are the upstreams counting in-flight requests by themselves, and
+	// inflight is used if it's nil.
+	live     []InflightW
+	inflight []atomic.Int64
+
+	// next is the index to start with, it's rotated to break ties.
+	next atomic.Uint64
+}
+
+// Distribute to implement least-connections algorithm, returns the idx of the choosing in ws ([]W).
+func (lcb *leastConnBalancer) Distribute() int {
+	n := len(lcb.weights)
+	if n == 0 {
+		return 0
+	}
+
+	start := int(lcb.next.Add(1) % uint64(n))
+	best, bestLoad := -1, int64(0)
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		if lcb.weights[idx] <= 0 {
+			continue
+		}
+
+		// compare (inflight+1)/weight without division, so that heavier
+		// upstream is preferred when their loads are equal.
+		load := lcb.load(idx) + 1
+		if best < 0 || load*lcb.weights[best] < bestLoad*lcb.weights[idx] {
+			best, bestLoad = idx, load
+		}
+	}
+
+	if best < 0 {
+		// all weights are zero.
+		best = start
+	}
+
+	if lcb.live == nil {
+		lcb.inflight[best].Add(1)
+	}
+	return best
+}
+
+// load returns the in-flight requests of upstream idx.
+func (lcb *leastConnBalancer) load(idx int) int64 {
+	if lcb.live != nil {
+		return lcb.live[idx].Inflight()
+	}
+
+	return lcb.inflight[idx].Load()
+}
+
+// Done implements IFeedbackBalancer.
+func (lcb *leastConnBalancer) Done(idx int, _ time.Duration, _ error) {
+	if lcb.live != nil || idx < 0 || idx >= len(lcb.inflight) {
+		// the upstreams count by themselves.
+		return
+	}
+
+	lcb.inflight[idx].Add(-1)
+}
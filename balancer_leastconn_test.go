@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_leastConnBalancer(t *testing.T) {
+	bla := NewLeastConnBalancer([]W{Weight(1), Weight(1), Weight(2)}).(IFeedbackBalancer)
+
+	// heavier upstream is preferred when loads are equal.
+	assert.Equal(t, 2, bla.Distribute())
+
+	count := make(map[int]int)
+	for i := 0; i < 3; i++ {
+		count[bla.Distribute()]++
+	}
+	// inflight: 0 -> 1, 1 -> 1, 2 -> 2
+	assert.Equal(t, map[int]int{0: 1, 1: 1, 2: 1}, count)
+
+	// upstream 0 finished, it has the least connections.
+	bla.Done(0, time.Millisecond, nil)
+	assert.Equal(t, 0, bla.Distribute())
+}
+
+// inflightWeight is an InflightW for tests.
+type inflightWeight struct {
+	weight   int
+	inflight int64
+}
+
+func (w *inflightWeight) Weight() int     { return w.weight }
+func (w *inflightWeight) Inflight() int64 { return w.inflight }
+
+func Test_leastConnBalancer_InflightW(t *testing.T) {
+	ws := []*inflightWeight{{weight: 1, inflight: 3}, {weight: 1, inflight: 1}, {weight: 2, inflight: 5}}
+	bla := NewLeastConnBalancer([]W{ws[0], ws[1], ws[2]}).(IFeedbackBalancer)
+
+	// the loads are read from ws, not counted by balancer.
+	for i := 0; i < 3; i++ {
+		idx := bla.Distribute()
+		assert.Equal(t, 1, idx)
+		bla.Done(idx, time.Millisecond, nil)
+	}
+
+	// a rebuilt balancer sees the same loads.
+	ws[1].inflight = 5
+	bla = NewLeastConnBalancer([]W{ws[0], ws[1], ws[2]}).(IFeedbackBalancer)
+	assert.Equal(t, 2, bla.Distribute())
+}
+
+func Test_leastConnBalancer_zeroWeights(t *testing.T) {
+	bla := NewLeastConnBalancer([]W{Weight(0), Weight(0)})
+
+	assert.NotPanics(t, func() {
+		for i := 0; i < 10; i++ {
+			idx := bla.Distribute()
+			assert.True(t, idx == 0 || idx == 1)
+		}
+	})
+
+	bla = NewLeastConnBalancer([]W{Weight(0), Weight(1)})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, bla.Distribute())
+	}
+}
+
+func Test_ReverseProxy_WithLeastConnBalancer(t *testing.T) {
+	var (
+		entered = make(chan struct{}, 10)
+		release = make(chan struct{})
+	)
+	slowAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		ctx.SetBodyString("slow")
+	})
+	fastAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("fast")
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{slowAddr: 1, fastAddr: 1}),
+		WithBalancerFactory(NewLeastConnBalancer),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	// hold a long request on slow upstream, the requests distributed to fast
+	// upstream finish immediately.
+	var wg sync.WaitGroup
+	for held := false; !held; {
+		finished := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(finished)
+			proxy.ServeHTTP(newTestRequestCtx(fasthttp.MethodGet, "http://example.com/slow"))
+		}()
+
+		select {
+		case <-entered:
+			held = true
+		case <-finished:
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		assert.Equal(t, "fast", string(ctx.Response.Body()))
+	}
+
+	// the long request is still counted after the balancer is rebuilt.
+	otherAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("other")
+	})
+	assert.Nil(t, proxy.AddUpstream(otherAddr, Weight(1)))
+	for i := 0; i < 10; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		assert.NotEqual(t, "slow", string(ctx.Response.Body()))
+	}
+
+	close(release)
+	wg.Wait()
+}
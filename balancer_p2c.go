@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// _p2cDecay is the time constant of peak EWMA, the weight of a sample
+	// decays to 1/e after it.
+	_p2cDecay = 10 * time.Second
+	// _p2cFailurePenalty is the latency recorded for a failed request, so that
+	// an upstream failing fast would not look like a fast one.
+	_p2cFailurePenalty = time.Second
+)
+
+// NewP2CBalancer constructs an IFeedbackBalancer instance which implements
+// power-of-two-choices algorithm with peak EWMA latency, like Finagle and
+// linkerd. Two upstreams are sampled randomly, and the one with the lower
+// cost, which is peak EWMA latency times in-flight requests divided by
+// weight, is chosen. The upstreams of ReverseProxy keep their latencies and
+// in-flight requests, so that they're kept when the balancer is rebuilt.
+// ref to: https://linkerd.io/2016/03/16/beyond-round-robin-load-balancing-for-latency/
+func NewP2CBalancer(ws []W) IBalancer {
+	p2c := &p2cBalancer{
+		weights: make([]float64, 0, len(ws)),
+		nodes:   make([]*p2cNode, 0, len(ws)),
+		choices: make([]int, 0, len(ws)),
+		decay:   _p2cDecay,
+		now:     time.Now,
+		live:    inflightWs(ws),
+	}
+
+	for idx, w := range ws {
+		if pw, ok := w.(p2cW); ok {
+			p2c.nodes = append(p2c.nodes, pw.p2cNode())
+		} else {
+			p2c.nodes = append(p2c.nodes, &p2cNode{})
+		}
+		p2c.weights = append(p2c.weights, float64(w.Weight()))
+		if w.Weight() > 0 {
+			p2c.choices = append(p2c.choices, idx)
+		}
+	}
+
+	if len(p2c.choices) == 0 {
+		// all weights are zero, take them equally.
+		for idx := range p2c.weights {
+			p2c.weights[idx] = 1
+			p2c.choices = append(p2c.choices, idx)
+		}
+	}
+
+	return p2c
+}
+
+// p2cBalancer is a power-of-two-choices balancer with peak EWMA latency.
+type p2cBalancer struct {
+	weights []float64
+	nodes   []*p2cNode
+	// live are the upstreams counting in-flight requests by themselves, and
+	// the inflight of nodes is used if it's nil.
+	live []InflightW
+	// choices are the indexes with positive weight.
+	choices []int
+
+	decay time.Duration
+	now   func() time.Time
+}
+
+// p2cW is a W keeping its p2cNode, such as upstream.
+type p2cW interface {
+	W
+
+	p2cNode() *p2cNode
+}
+
+// p2cNode keeps the load of an upstream.
+type p2cNode struct {
+	// inflight is not used if the upstream is InflightW.
+	inflight atomic.Int64
+
+	mutex sync.Mutex
+	// ewma is the peak EWMA latency in nanoseconds.
+	ewma float64
+	// stamp is the time of last update of ewma.
+	stamp time.Time
+}
+
+// cost returns the load of node with inflight requests, the lower is the better.
+func (n *p2cNode) cost(weight float64, inflight int64) float64 {
+	n.mutex.Lock()
+	ewma := n.ewma
+	n.mutex.Unlock()
+
+	// the latency of an upstream without samples is unknown, take it as
+	// a tiny one so that it would be tried.
+	if ewma == 0 {
+		ewma = 1
+	}
+
+	return ewma * float64(inflight+1) / weight
+}
+
+// observe records the latency of a request.
+func (n *p2cNode) observe(rtt time.Duration, now time.Time, decay time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	sample := float64(rtt)
+	if n.stamp.IsZero() || sample > n.ewma {
+		// peak sensitive: take the bigger one immediately.
+		n.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(n.stamp)) / float64(decay))
+		n.ewma = n.ewma*w + sample*(1-w)
+	}
+	n.stamp = now
+}
+
+// Distribute to implement power-of-two-choices algorithm, returns the idx of the choosing in ws ([]W).
+func (p2c *p2cBalancer) Distribute() int {
+	best := 0
+	switch n := len(p2c.choices); n {
+	case 0:
+		return 0
+	case 1:
+		best = p2c.choices[0]
+	default:
+		i := rand.Intn(n)
+		j := rand.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+
+		a, b := p2c.choices[i], p2c.choices[j]
+		best = a
+		if p2c.cost(b) < p2c.cost(a) {
+			best = b
+		}
+	}
+
+	if p2c.live == nil {
+		p2c.nodes[best].inflight.Add(1)
+	}
+	return best
+}
+
+// cost returns the load of upstream idx.
+func (p2c *p2cBalancer) cost(idx int) float64 {
+	node := p2c.nodes[idx]
+	if p2c.live != nil {
+		return node.cost(p2c.weights[idx], p2c.live[idx].Inflight())
+	}
+
+	return node.cost(p2c.weights[idx], node.inflight.Load())
+}
+
+// Done implements IFeedbackBalancer.
+func (p2c *p2cBalancer) Done(idx int, elapsed time.Duration, err error) {
+	if idx < 0 || idx >= len(p2c.nodes) {
+		return
+	}
+
+	node := p2c.nodes[idx]
+	if p2c.live == nil {
+		node.inflight.Add(-1)
+	}
+	if elapsed <= 0 {
+		// not used
+		return
+	}
+
+	if err != nil && elapsed < _p2cFailurePenalty {
+		elapsed = _p2cFailurePenalty
+	}
+	node.observe(elapsed, p2c.now(), p2c.decay)
+}
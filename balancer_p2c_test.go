@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_p2cNode_observe(t *testing.T) {
+	var (
+		node = &p2cNode{}
+		now  = time.Now()
+	)
+
+	node.observe(10*time.Millisecond, now, time.Second)
+	assert.Equal(t, float64(10*time.Millisecond), node.ewma)
+
+	// peak is taken immediately.
+	node.observe(100*time.Millisecond, now, time.Second)
+	assert.Equal(t, float64(100*time.Millisecond), node.ewma)
+
+	// lower latency decays slowly.
+	node.observe(10*time.Millisecond, now.Add(time.Second), time.Second)
+	want := float64(100*time.Millisecond)/math.E + float64(10*time.Millisecond)*(1-1/math.E)
+	assert.InDelta(t, want, node.ewma, 1)
+}
+
+func Test_p2cBalancer(t *testing.T) {
+	bla := NewP2CBalancer([]W{Weight(1), Weight(1), Weight(1)}).(IFeedbackBalancer)
+
+	// upstream 0 is degraded.
+	bla.(*p2cBalancer).nodes[0].observe(time.Second, time.Now(), time.Minute)
+	bla.(*p2cBalancer).nodes[1].observe(time.Millisecond, time.Now(), time.Minute)
+	bla.(*p2cBalancer).nodes[2].observe(time.Millisecond, time.Now(), time.Minute)
+
+	count := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		idx := bla.Distribute()
+		count[idx]++
+		bla.Done(idx, 0, nil)
+	}
+
+	assert.Zero(t, count[0], "degraded upstream should never win two choices")
+	assert.NotZero(t, count[1])
+	assert.NotZero(t, count[2])
+}
+
+func Test_p2cBalancer_failurePenalty(t *testing.T) {
+	bla := NewP2CBalancer([]W{Weight(1), Weight(1)}).(*p2cBalancer)
+
+	bla.Done(bla.Distribute(), time.Microsecond, errors.New("refused"))
+	idx := 0
+	if bla.nodes[1].ewma != 0 {
+		idx = 1
+	}
+
+	assert.Equal(t, float64(_p2cFailurePenalty), bla.nodes[idx].ewma)
+	assert.Zero(t, bla.nodes[idx].inflight.Load())
+}
+
+func Test_p2cBalancer_weights(t *testing.T) {
+	bla := NewP2CBalancer([]W{Weight(0), Weight(3)})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, bla.Distribute())
+	}
+
+	bla = NewP2CBalancer([]W{Weight(0), Weight(0)})
+	assert.NotPanics(t, func() { bla.Distribute() })
+}
+
+func Test_p2cBalancer_rebuild(t *testing.T) {
+	// both upstreams are compared in each choice with two of them.
+	us := []*upstream{{weight: 1}, {weight: 1}}
+	ws := []W{us[0], us[1]}
+
+	bla := NewP2CBalancer(ws).(IFeedbackBalancer)
+	bla.Done(bla.Distribute(), time.Second, nil)
+	for i := 0; i < 100; i++ {
+		bla.Done(bla.Distribute(), time.Millisecond, nil)
+	}
+
+	degraded := -1
+	for idx, u := range us {
+		if u.p2c.ewma >= float64(100*time.Millisecond) {
+			degraded = idx
+		}
+	}
+	assert.NotEqual(t, -1, degraded)
+
+	// the latencies are kept by upstreams, a rebuilt balancer knows them.
+	bla = NewP2CBalancer(ws).(IFeedbackBalancer)
+	for i := 0; i < 100; i++ {
+		idx := bla.Distribute()
+		assert.NotEqual(t, degraded, idx)
+		bla.Done(idx, 0, nil)
+	}
+
+	// the in-flight requests are read from upstreams.
+	for idx, u := range us {
+		if idx != degraded {
+			u.inflight.Store(1 << 20)
+		}
+	}
+	assert.Equal(t, degraded, NewP2CBalancer(ws).Distribute())
+}
+
+func Test_ReverseProxy_WithP2CBalancer(t *testing.T) {
+	slowAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(20 * time.Millisecond)
+		ctx.SetBodyString("slow")
+	})
+	fastAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("fast")
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{slowAddr: 1, fastAddr: 1}),
+		WithBalancerFactory(NewP2CBalancer),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	count := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		count[string(ctx.Response.Body())]++
+	}
+
+	// with two upstreams, the slow one is only chosen before its latency is known.
+	assert.LessOrEqual(t, count["slow"], 1)
+}
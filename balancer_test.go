@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"reflect"
 	"sync"
 	"testing"
 )
@@ -77,3 +78,177 @@ func Test_balancer_concurrent(t *testing.T) {
 	wg.Wait()
 	t.Log(count)
 }
+
+func Test_balancer_smooth(t *testing.T) {
+	bla := NewBalancer([]W{Weight(5), Weight(1), Weight(1)})
+
+	got := make([]int, 0, 14)
+	for i := 0; i < 14; i++ {
+		got = append(got, bla.Distribute())
+	}
+
+	// the heaviest one is interleaved instead of bursting.
+	want := []int{0, 0, 1, 0, 2, 0, 0}
+	if !reflect.DeepEqual(got, append(want, want...)) {
+		t.Errorf("want %v, got: %v", append(want, want...), got)
+	}
+}
+
+func Test_balancer_zeroWeights(t *testing.T) {
+	bla := NewBalancer([]W{Weight(0), Weight(0), Weight(0)})
+
+	count := make(map[int]int)
+	for i := 0; i < 30; i++ {
+		count[bla.Distribute()]++
+	}
+	if !reflect.DeepEqual(count, map[int]int{0: 10, 1: 10, 2: 10}) {
+		t.Errorf("all zero weights should be taken equally, got: %v", count)
+	}
+
+	bla = NewBalancer([]W{Weight(0), Weight(1)})
+	for i := 0; i < 10; i++ {
+		if idx := bla.Distribute(); idx != 1 {
+			t.Errorf("zero weight should never be chosen, got: %d", idx)
+		}
+	}
+
+	if idx := NewBalancer(nil).Distribute(); idx != 0 {
+		t.Errorf("want 0, got: %d", idx)
+	}
+}
+
+func Test_balancer_update(t *testing.T) {
+	bla := NewBalancer([]W{Weight(1), Weight(1)})
+	bla.(IUpdatableBalancer).Update([]W{Weight(0), Weight(3)})
+
+	for i := 0; i < 10; i++ {
+		if idx := bla.Distribute(); idx != 1 {
+			t.Errorf("want 1, got: %d", idx)
+		}
+	}
+}
+
+func Test_smoothSchedule_cap(t *testing.T) {
+	schedule := smoothSchedule([]W{Weight(_maxScheduleLen * 4), Weight(1), Weight(_maxScheduleLen*2 + 1)})
+
+	if len(schedule) > _maxScheduleLen+3 {
+		t.Errorf("schedule should be capped, got: %d", len(schedule))
+	}
+
+	count := make(map[int]int)
+	for _, idx := range schedule {
+		count[idx]++
+	}
+	if count[1] == 0 {
+		t.Errorf("positive weight should be chosen at least once")
+	}
+}
+
+func Test_smoothSchedule_manyUpstreams(t *testing.T) {
+	const n = 1000
+	ws := make([]W, 0, n)
+	for i := 0; i < n; i++ {
+		ws = append(ws, Weight(100+i%2*100))
+	}
+	schedule := smoothSchedule(ws)
+
+	// the upstreams with the same weight are computed as a group, the schedule
+	// is not shortened.
+	if len(schedule) != n*3/2 {
+		t.Errorf("schedule should be %d long, got: %d", n*3/2, len(schedule))
+	}
+
+	count := make([]int, n)
+	for _, idx := range schedule {
+		count[idx]++
+	}
+	for idx, c := range count {
+		if want := 1 + idx%2; c != want {
+			t.Errorf("upstream %d should be chosen %d times, got: %d", idx, want, c)
+			break
+		}
+	}
+
+	// the work is bounded by shortening the schedule if the weights are distinct.
+	ws = ws[:0]
+	for i := 0; i < n; i++ {
+		ws = append(ws, Weight(i+1))
+	}
+	if maxLen := _maxScheduleWork/n + n; len(smoothSchedule(ws)) > maxLen {
+		t.Errorf("schedule should be shortened to %d, got: %d", maxLen, len(smoothSchedule(ws)))
+	}
+}
+
+// mutexRoundRobinBalancer is the previous interleaved weighted round-robin
+// balancer with mutex, it's kept as the baseline of benchmarks.
+type mutexRoundRobinBalancer struct {
+	mutex     sync.Mutex
+	weights   []int
+	maxWeight int
+	maxGCD    int
+	i         int
+	cw        int
+}
+
+func newMutexRoundRobinBalancer(ws []W) IBalancer {
+	rrb := &mutexRoundRobinBalancer{weights: make([]int, len(ws)), i: -1}
+	for idx, w := range ws {
+		rrb.weights[idx] = w.Weight()
+		if w.Weight() > rrb.maxWeight {
+			rrb.maxWeight = w.Weight()
+		}
+	}
+	rrb.maxGCD = nGCD(rrb.weights, len(rrb.weights))
+
+	return rrb
+}
+
+func (rrb *mutexRoundRobinBalancer) Distribute() int {
+	rrb.mutex.Lock()
+	defer rrb.mutex.Unlock()
+
+	for {
+		rrb.i = (rrb.i + 1) % len(rrb.weights)
+		if rrb.i == 0 {
+			rrb.cw = rrb.cw - rrb.maxGCD
+			if rrb.cw <= 0 {
+				rrb.cw = rrb.maxWeight
+				if rrb.cw == 0 {
+					return 0
+				}
+			}
+		}
+
+		if rrb.weights[rrb.i] >= rrb.cw {
+			return rrb.i
+		}
+	}
+}
+
+func benchmarkBalancerParallel(b *testing.B, factory BalancerFactory) {
+	bla := factory([]W{Weight(20), Weight(30), Weight(50), Weight(10), Weight(40)})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = bla.Distribute()
+		}
+	})
+}
+
+func Benchmark_balancer_parallel(b *testing.B) {
+	benchmarkBalancerParallel(b, NewBalancer)
+}
+
+func Benchmark_mutexBalancer_parallel(b *testing.B) {
+	benchmarkBalancerParallel(b, newMutexRoundRobinBalancer)
+}
+
+func Benchmark_leastConnBalancer_parallel(b *testing.B) {
+	benchmarkBalancerParallel(b, NewLeastConnBalancer)
+}
+
+func Benchmark_p2cBalancer_parallel(b *testing.B) {
+	benchmarkBalancerParallel(b, NewP2CBalancer)
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// _breakerBuckets is the number of buckets of the sliding window.
+const _breakerBuckets = 10
+
+// BreakerState is the state of circuit breaker.
+type BreakerState uint8
+
+const (
+	// BreakerClosed denotes requests are sent to upstream as usual.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen denotes requests are not sent to upstream.
+	BreakerOpen
+	// BreakerHalfOpen denotes a few requests are sent to upstream to probe
+	// whether it has recovered.
+	BreakerHalfOpen
+)
+
+// String returns the name of BreakerState.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	}
+
+	return "closed"
+}
+
+// CircuitBreaker configures the circuit breaker of each upstream. The breaker
+// opens when the upstream fails consecutively or the error rate in sliding
+// window is too high, and the requests are not sent to it until OpenTimeout
+// passed. Then the breaker becomes half-open, and it's closed if the probing
+// requests succeed, or opened again if any of them fails. Connection errors,
+// timeouts and 5xx responses are considered as failures.
+type CircuitBreaker struct {
+	// Window is the length of sliding window to calculate error rate, default is 10s.
+	Window time.Duration
+	// MinRequests is the minimum number of requests in window to calculate
+	// error rate, default is 20.
+	MinRequests int
+	// ErrorRate in (0, 1] to open the breaker, default is 0.5.
+	ErrorRate float64
+	// ConsecutiveFailures is the number of consecutive failures to open the
+	// breaker, default is 5.
+	ConsecutiveFailures int
+	// OpenTimeout is the time to stay open before probing, default is 30s.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probing requests in half-open state,
+	// all of them must succeed to close the breaker, default is 1.
+	HalfOpenRequests int
+	// Failover sends the request to another upstream if the breaker of chosen
+	// one is not closed, otherwise the request fails fast with 503.
+	Failover bool
+	// OnStateChange is called when the state of breaker of upstream changes.
+	OnStateChange func(upstream string, from, to BreakerState)
+}
+
+// withDefaults fills the zero fields with default values.
+func (cb CircuitBreaker) withDefaults() CircuitBreaker {
+	if cb.Window <= 0 {
+		cb.Window = 10 * time.Second
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = 20
+	}
+	if cb.ErrorRate <= 0 || cb.ErrorRate > 1 {
+		cb.ErrorRate = 0.5
+	}
+	if cb.ConsecutiveFailures <= 0 {
+		cb.ConsecutiveFailures = 5
+	}
+	if cb.OpenTimeout <= 0 {
+		cb.OpenTimeout = 30 * time.Second
+	}
+	if cb.HalfOpenRequests <= 0 {
+		cb.HalfOpenRequests = 1
+	}
+
+	return cb
+}
+
+// breakerBucket counts the requests in a period of sliding window.
+type breakerBucket struct {
+	period   int64
+	total    int
+	failures int
+}
+
+// breakerState keeps the states of circuit breaker of an upstream.
+type breakerState struct {
+	mutex sync.Mutex
+
+	state       BreakerState
+	consecutive int
+	buckets     [_breakerBuckets]breakerBucket
+	openedAt    time.Time
+
+	// probes is the number of probing requests in flight, and successes is
+	// the number of succeeded ones in half-open state.
+	probes    int
+	successes int
+}
+
+// current returns the state of breaker.
+func (s *breakerState) current() BreakerState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state
+}
+
+// allow reports whether a request could be sent to upstream, probe is true if
+// the request is a probing request in half-open state.
+func (s *breakerState) allow(cb *CircuitBreaker, now time.Time) (allowed, probe bool, from, to BreakerState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	from = s.state
+	if s.state == BreakerOpen && now.Sub(s.openedAt) >= cb.OpenTimeout {
+		s.state = BreakerHalfOpen
+		s.probes, s.successes = 0, 0
+	}
+
+	switch s.state {
+	case BreakerClosed:
+		allowed = true
+	case BreakerHalfOpen:
+		if s.probes+s.successes < cb.HalfOpenRequests {
+			s.probes++
+			allowed, probe = true, true
+		}
+	}
+
+	return allowed, probe, from, s.state
+}
+
+// record records the result of a request allowed by allow.
+func (s *breakerState) record(cb *CircuitBreaker, now time.Time, failed, probe bool) (from, to BreakerState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	from = s.state
+	switch {
+	case probe && s.state == BreakerHalfOpen:
+		s.probes--
+		if failed {
+			s.open(now)
+		} else if s.successes++; s.successes >= cb.HalfOpenRequests {
+			s.reset()
+		}
+	case !probe && s.state == BreakerClosed:
+		s.count(cb, now, failed)
+		if !failed {
+			s.consecutive = 0
+			break
+		}
+
+		s.consecutive++
+		total, failures := s.sum(cb, now)
+		if s.consecutive >= cb.ConsecutiveFailures ||
+			(total >= cb.MinRequests && float64(failures) >= cb.ErrorRate*float64(total)) {
+			s.open(now)
+		}
+	}
+
+	return from, s.state
+}
+
+// open opens the breaker, s.mutex must be held by caller.
+func (s *breakerState) open(now time.Time) {
+	s.state = BreakerOpen
+	s.openedAt = now
+	s.probes, s.successes = 0, 0
+}
+
+// reset closes the breaker and clears the counters, s.mutex must be held by caller.
+func (s *breakerState) reset() {
+	s.state = BreakerClosed
+	s.consecutive = 0
+	s.buckets = [_breakerBuckets]breakerBucket{}
+	s.probes, s.successes = 0, 0
+}
+
+// period returns the period of bucket which now belongs to.
+func period(cb *CircuitBreaker, now time.Time) int64 {
+	return now.UnixNano() / int64(cb.Window/_breakerBuckets)
+}
+
+// count counts the request into sliding window, s.mutex must be held by caller.
+func (s *breakerState) count(cb *CircuitBreaker, now time.Time, failed bool) {
+	p := period(cb, now)
+	b := &s.buckets[p%_breakerBuckets]
+	if b.period != p {
+		*b = breakerBucket{period: p}
+	}
+
+	b.total++
+	if failed {
+		b.failures++
+	}
+}
+
+// sum sums the requests in sliding window, s.mutex must be held by caller.
+func (s *breakerState) sum(cb *CircuitBreaker, now time.Time) (total, failures int) {
+	p := period(cb, now)
+	for _, b := range s.buckets {
+		if p-b.period < _breakerBuckets {
+			total += b.total
+			failures += b.failures
+		}
+	}
+
+	return total, failures
+}
+
+// allowBreaker reports whether the request could be sent to u by its circuit breaker.
+func (p *ReverseProxy) allowBreaker(u *upstream) (allowed, probe bool) {
+	cb := p.opt.circuitBreaker
+	if cb == nil {
+		return true, false
+	}
+
+	allowed, probe, from, to := u.breaker.allow(cb, time.Now())
+	p.onBreakerStateChange(u, from, to)
+	return allowed, probe
+}
+
+// recordBreaker records the result of a request allowed by allowBreaker.
+func (p *ReverseProxy) recordBreaker(u *upstream, probe bool, statusCode int, err error) {
+	cb := p.opt.circuitBreaker
+	if cb == nil {
+		return
+	}
+
+	failed := statusCode >= 500
+	if err != nil {
+		kind := classifyError(err)
+		// not the fault of upstream.
+		failed = kind != ErrorKindNoUpstream && kind != ErrorKindResponse
+	}
+
+	from, to := u.breaker.record(cb, time.Now(), failed, probe)
+	p.onBreakerStateChange(u, from, to)
+}
+
+func (p *ReverseProxy) onBreakerStateChange(u *upstream, from, to BreakerState) {
+	if from == to {
+		return
+	}
+
+	if to == BreakerOpen {
+		errorF(p.opt.logger, "circuit breaker: upstream %s changes from %s to %s", u.Addr, from, to)
+	} else {
+		debugF(p.opt.debug, p.opt.logger, "circuit breaker: upstream %s changes from %s to %s", u.Addr, from, to)
+	}
+
+	if cb := p.opt.circuitBreaker; cb.OnStateChange != nil {
+		cb.OnStateChange(u.name, from, to)
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_breakerState_consecutiveFailures(t *testing.T) {
+	cb := CircuitBreaker{ConsecutiveFailures: 3, OpenTimeout: time.Second, HalfOpenRequests: 2}.withDefaults()
+	s := &breakerState{}
+	now := time.Now()
+
+	record := func(failed bool) BreakerState {
+		allowed, probe, _, _ := s.allow(&cb, now)
+		assert.True(t, allowed)
+		_, to := s.record(&cb, now, failed, probe)
+		return to
+	}
+
+	assert.Equal(t, BreakerClosed, record(true))
+	assert.Equal(t, BreakerClosed, record(true))
+	assert.Equal(t, BreakerClosed, record(false))
+	assert.Equal(t, BreakerClosed, record(true))
+	assert.Equal(t, BreakerClosed, record(true))
+	assert.Equal(t, BreakerOpen, record(true))
+
+	// open: fail fast until OpenTimeout passed.
+	allowed, _, _, _ := s.allow(&cb, now.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+
+	// half-open: only HalfOpenRequests probes are allowed.
+	now = now.Add(time.Second)
+	allowed, probe, from, to := s.allow(&cb, now)
+	assert.True(t, allowed)
+	assert.True(t, probe)
+	assert.Equal(t, BreakerOpen, from)
+	assert.Equal(t, BreakerHalfOpen, to)
+	allowed2, probe2, _, _ := s.allow(&cb, now)
+	assert.True(t, allowed2)
+	allowed3, _, _, _ := s.allow(&cb, now)
+	assert.False(t, allowed3)
+
+	// a failed probe opens the breaker again.
+	_, to = s.record(&cb, now, true, probe)
+	assert.Equal(t, BreakerOpen, to)
+	// the result of the other probe is ignored.
+	_, to = s.record(&cb, now, false, probe2)
+	assert.Equal(t, BreakerOpen, to)
+
+	// all probes succeed to close the breaker.
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		allowed, probe, _, _ = s.allow(&cb, now)
+		assert.True(t, allowed)
+		_, to = s.record(&cb, now, false, probe)
+	}
+	assert.Equal(t, BreakerClosed, to)
+}
+
+func Test_breakerState_errorRate(t *testing.T) {
+	cb := CircuitBreaker{
+		Window:              time.Second,
+		MinRequests:         10,
+		ErrorRate:           0.5,
+		ConsecutiveFailures: 100,
+	}.withDefaults()
+	s := &breakerState{}
+	now := time.Now()
+
+	// 4 failures of 9 requests, not enough requests.
+	for i := 0; i < 9; i++ {
+		_, to := s.record(&cb, now, i%2 == 1, false)
+		assert.Equal(t, BreakerClosed, to)
+	}
+
+	// the requests out of window are not counted.
+	now = now.Add(2 * time.Second)
+	_, to := s.record(&cb, now, true, false)
+	assert.Equal(t, BreakerClosed, to)
+	total, failures := s.sum(&cb, now)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, failures)
+
+	for i := 0; i < 8; i++ {
+		_, to = s.record(&cb, now, i%2 == 1, false)
+		assert.Equal(t, BreakerClosed, to)
+	}
+	// 5 failures of 10 requests.
+	_, to = s.record(&cb, now, true, false)
+	assert.Equal(t, BreakerOpen, to)
+}
+
+func Test_ReverseProxy_WithCircuitBreaker(t *testing.T) {
+	goodAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("good")
+	})
+	badAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	})
+
+	testCases := []struct {
+		desc     string
+		failover bool
+		want     map[int]int
+	}{
+		{
+			desc:     "fail fast",
+			failover: false,
+			want:     map[int]int{fasthttp.StatusOK: 2, fasthttp.StatusServiceUnavailable: 2},
+		},
+		{
+			desc:     "failover",
+			failover: true,
+			want:     map[int]int{fasthttp.StatusOK: 4},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var (
+				mutex   sync.Mutex
+				changes []BreakerState
+			)
+			proxy, err := NewReverseProxyWith(
+				WithBalancer(map[string]Weight{goodAddr: 1, badAddr: 1}),
+				WithCircuitBreaker(CircuitBreaker{
+					ConsecutiveFailures: 2,
+					OpenTimeout:         time.Hour,
+					Failover:            tC.failover,
+					OnStateChange: func(upstream string, from, to BreakerState) {
+						assert.Equal(t, badAddr, upstream)
+						mutex.Lock()
+						changes = append(changes, to)
+						mutex.Unlock()
+					},
+				}),
+			)
+			assert.Nil(t, err)
+			defer proxy.Close()
+
+			// open the breaker of bad upstream.
+			for i := 0; i < 4; i++ {
+				proxy.ServeHTTP(newTestRequestCtx(fasthttp.MethodGet, "http://example.com/"))
+			}
+			assert.Equal(t, BreakerOpen, findStats(proxy.Upstreams(), badAddr).Breaker)
+			assert.Equal(t, BreakerClosed, findStats(proxy.Upstreams(), goodAddr).Breaker)
+
+			statuses := make(map[int]int)
+			for i := 0; i < 4; i++ {
+				ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+				proxy.ServeHTTP(ctx)
+				statuses[ctx.Response.StatusCode()]++
+			}
+			assert.Equal(t, tC.want, statuses)
+
+			mutex.Lock()
+			assert.Equal(t, []BreakerState{BreakerOpen}, changes)
+			mutex.Unlock()
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// _canaryKey is the key of user value which denotes the request is served by canary.
+const _canaryKey = "fasthttp-reverse-proxy.canary"
+
+// _canaryBuckets is the resolution of canary percentage, 0.01%.
+const _canaryBuckets = 10000
+
+// CanaryRule sends the requests to canary if the key matches.
+type CanaryRule struct {
+	// Key extracts the value to match, such as HeaderKey("X-Canary"),
+	// CookieKey("canary") or QueryArgKey("canary").
+	Key KeyFunc
+	// Value to match, empty means any non-empty value matches.
+	Value string
+}
+
+// match reports whether the request matches the rule.
+func (r CanaryRule) match(ctx *fasthttp.RequestCtx) bool {
+	value := r.Key(ctx)
+	if len(value) == 0 {
+		return false
+	}
+
+	return r.Value == "" || string(value) == r.Value
+}
+
+// Canary splits the requests between the stable and canary backends, such as
+// two ReverseProxy with different upstreams. The requests matching any of the
+// rules are sent to canary, otherwise a percentage of requests are sent to
+// canary by the hash of key, so that a user stays on the same backend. As the
+// percentage increases, the users on canary stay on canary. It's safe to change
+// the percentage while serving.
+type Canary struct {
+	stable Handler
+	canary Handler
+	rules  []CanaryRule
+	key    KeyFunc
+
+	// buckets is the percentage in _canaryBuckets.
+	buckets atomic.Uint32
+}
+
+// NewCanary creates a Canary sending no request to canary except the ones
+// matching rules, the rules without Key are dropped. key is used to split the
+// others by percentage, ClientIPKey is used if it's nil. The requests without
+// key are split randomly.
+func NewCanary(stable, canary Handler, key KeyFunc, rules ...CanaryRule) *Canary {
+	if key == nil {
+		key = ClientIPKey
+	}
+
+	valid := make([]CanaryRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Key == nil {
+			continue
+		}
+		valid = append(valid, rule)
+	}
+
+	return &Canary{
+		stable: stable,
+		canary: canary,
+		rules:  valid,
+		key:    key,
+	}
+}
+
+// SetPercent sets the percentage in [0, 100] of requests sent to canary.
+func (c *Canary) SetPercent(percent float64) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	c.buckets.Store(uint32(math.Round(percent * _canaryBuckets / 100)))
+}
+
+// Percent returns the percentage of requests sent to canary.
+func (c *Canary) Percent() float64 {
+	return float64(c.buckets.Load()) * 100 / _canaryBuckets
+}
+
+// ServeHTTP sends the request to canary or stable backend.
+func (c *Canary) ServeHTTP(ctx *fasthttp.RequestCtx) {
+	if c.isCanary(ctx) {
+		ctx.SetUserValue(_canaryKey, true)
+		c.canary.ServeHTTP(ctx)
+		return
+	}
+
+	c.stable.ServeHTTP(ctx)
+}
+
+// isCanary reports whether the request should be sent to canary.
+func (c *Canary) isCanary(ctx *fasthttp.RequestCtx) bool {
+	for _, rule := range c.rules {
+		if rule.match(ctx) {
+			return true
+		}
+	}
+
+	buckets := c.buckets.Load()
+	if buckets == 0 {
+		return false
+	}
+
+	var h uint64
+	if key := c.key(ctx); len(key) != 0 {
+		h = hashKey(key)
+	} else {
+		h = rand.Uint64()
+	}
+
+	return uint32(h%_canaryBuckets) < buckets
+}
+
+// IsCanary reports whether the request in ctx is served by canary of Canary.
+func IsCanary(ctx *fasthttp.RequestCtx) bool {
+	canary, _ := ctx.UserValue(_canaryKey).(bool)
+	return canary
+}
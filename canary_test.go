@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_Canary_rules(t *testing.T) {
+	c := NewCanary(namedHandler("stable"), namedHandler("canary"), nil,
+		CanaryRule{Key: HeaderKey("X-Canary")},
+		CanaryRule{Key: CookieKey("release"), Value: "beta"},
+		CanaryRule{Key: QueryArgKey("canary"), Value: "1"},
+	)
+
+	testCases := []struct {
+		desc   string
+		uri    string
+		header string
+		cookie string
+		canary bool
+	}{
+		{desc: "no rule matched", uri: "http://example.com/", canary: false},
+		{desc: "header present", uri: "http://example.com/", header: "yes", canary: true},
+		{desc: "cookie matched", uri: "http://example.com/", cookie: "beta", canary: true},
+		{desc: "cookie not matched", uri: "http://example.com/", cookie: "stable", canary: false},
+		{desc: "query arg matched", uri: "http://example.com/?canary=1", canary: true},
+		{desc: "query arg not matched", uri: "http://example.com/?canary=0", canary: false},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctx := newTestRequestCtx(fasthttp.MethodGet, tC.uri)
+			if tC.header != "" {
+				ctx.Request.Header.Set("X-Canary", tC.header)
+			}
+			if tC.cookie != "" {
+				ctx.Request.Header.SetCookie("release", tC.cookie)
+			}
+
+			c.ServeHTTP(ctx)
+			assert.Equal(t, tC.canary, IsCanary(ctx))
+			if tC.canary {
+				assert.Equal(t, "canary:", string(ctx.Response.Body()))
+			} else {
+				assert.Equal(t, "stable:", string(ctx.Response.Body()))
+			}
+		})
+	}
+}
+
+func Test_Canary_rulesWithoutKey(t *testing.T) {
+	c := NewCanary(namedHandler("stable"), namedHandler("canary"), nil,
+		CanaryRule{Value: "beta"},
+		CanaryRule{Key: HeaderKey("X-Canary")},
+	)
+	assert.Len(t, c.rules, 1)
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	assert.NotPanics(t, func() { c.ServeHTTP(ctx) })
+	assert.Equal(t, "stable:", string(ctx.Response.Body()))
+
+	ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	ctx.Request.Header.Set("X-Canary", "1")
+	c.ServeHTTP(ctx)
+	assert.Equal(t, "canary:", string(ctx.Response.Body()))
+}
+
+func Test_Canary_SetPercent(t *testing.T) {
+	c := NewCanary(namedHandler("stable"), namedHandler("canary"), HeaderKey("X-User"))
+	assert.Equal(t, float64(0), c.Percent())
+
+	c.SetPercent(12.5)
+	assert.Equal(t, 12.5, c.Percent())
+	c.SetPercent(-1)
+	assert.Equal(t, float64(0), c.Percent())
+	c.SetPercent(200)
+	assert.Equal(t, float64(100), c.Percent())
+}
+
+func Test_Canary_percent(t *testing.T) {
+	c := NewCanary(namedHandler("stable"), namedHandler("canary"), HeaderKey("X-User"))
+
+	serve := func(user string) bool {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		ctx.Request.Header.Set("X-User", user)
+		c.ServeHTTP(ctx)
+		return IsCanary(ctx)
+	}
+
+	const users = 2000
+	split := func() map[string]bool {
+		canaries := make(map[string]bool)
+		for i := 0; i < users; i++ {
+			user := "user-" + strconv.Itoa(i)
+			if serve(user) {
+				canaries[user] = true
+			}
+		}
+		return canaries
+	}
+
+	assert.Empty(t, split())
+
+	c.SetPercent(10)
+	canaries := split()
+	assert.InDelta(t, users*0.1, len(canaries), users*0.03)
+
+	// a user stays on the same backend.
+	for user := range canaries {
+		assert.True(t, serve(user))
+	}
+
+	// users on canary stay on canary as the percentage increases.
+	c.SetPercent(50)
+	more := split()
+	assert.InDelta(t, users*0.5, len(more), users*0.05)
+	for user := range canaries {
+		assert.True(t, more[user])
+	}
+
+	c.SetPercent(100)
+	assert.Len(t, split(), users)
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Target is an upstream server discovered by Discoverer.
+type Target struct {
+	// Addr of upstream server, such as "10.0.0.1:8080".
+	Addr string `json:"addr" yaml:"addr"`
+	// Weight of upstream server, 1 is used if it's not positive.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// Metadata of upstream server.
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+func (t Target) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+
+	return t.Weight
+}
+
+// Discoverer discovers upstream servers and pushes the updates of upstream set
+// into ReverseProxy.
+type Discoverer interface {
+	// Watch calls update with the full set of targets each time the set changes,
+	// it blocks until ctx is done.
+	Watch(ctx context.Context, update func(targets []Target)) error
+}
+
+// watchDiscoverer runs the Discoverer until ReverseProxy is closed.
+func (p *ReverseProxy) watchDiscoverer(d Discoverer) {
+	defer p.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-p.done
+		cancel()
+	}()
+
+	err := d.Watch(ctx, func(targets []Target) {
+		debugF(p.opt.debug, p.opt.logger, "discoverer: update upstreams, targets = %v", targets)
+		p.SetUpstreams(targets)
+	})
+	if err != nil && ctx.Err() == nil {
+		errorF(p.opt.logger, "discoverer: watch failed, err = %v", err)
+	}
+}
+
+// sortTargets sorts targets by address to compare two sets of targets.
+func sortTargets(targets []Target) []Target {
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Addr < targets[j].Addr
+	})
+
+	return targets
+}
+
+// staticDiscoverer pushes a fixed set of targets.
+type staticDiscoverer struct {
+	targets []Target
+}
+
+// NewStaticDiscoverer creates a Discoverer with a fixed set of targets.
+func NewStaticDiscoverer(targets ...Target) Discoverer {
+	return staticDiscoverer{targets: targets}
+}
+
+// Watch implements Discoverer.
+func (d staticDiscoverer) Watch(ctx context.Context, update func(targets []Target)) error {
+	update(d.targets)
+	<-ctx.Done()
+	return nil
+}
+
+// FileDiscoverer reads targets from a JSON or YAML file, the file is watched
+// and targets would be pushed again once the file changes. The file contains
+// a list of Target, the format is decided by extension: ".yaml" and ".yml"
+// for YAML, JSON otherwise.
+type FileDiscoverer struct {
+	// Path of the file.
+	Path string
+	// Interval to check whether the file changes, default is 5s.
+	Interval time.Duration
+	// OnError is called when the file could not be read or parsed,
+	// the last good set of targets is kept.
+	OnError func(err error)
+}
+
+// NewFileDiscoverer creates a FileDiscoverer.
+func NewFileDiscoverer(path string, interval time.Duration) *FileDiscoverer {
+	return &FileDiscoverer{
+		Path:     path,
+		Interval: interval,
+	}
+}
+
+// Watch implements Discoverer.
+func (d *FileDiscoverer) Watch(ctx context.Context, update func(targets []Target)) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		modTime time.Time
+		size    int64 = -1
+		last    []Target
+	)
+	for {
+		if fi, err := os.Stat(d.Path); err != nil {
+			d.onError(err)
+		} else if !fi.ModTime().Equal(modTime) || fi.Size() != size {
+			targets, err := d.load()
+			if err != nil {
+				d.onError(err)
+			} else {
+				modTime, size = fi.ModTime(), fi.Size()
+				if last == nil || !reflect.DeepEqual(last, targets) {
+					last = targets
+					update(targets)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *FileDiscoverer) load() ([]Target, error) {
+	data, err := os.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, 4)
+	switch strings.ToLower(filepath.Ext(d.Path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &targets)
+	default:
+		err = json.Unmarshal(data, &targets)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", d.Path, err)
+	}
+
+	return sortTargets(targets), nil
+}
+
+func (d *FileDiscoverer) onError(err error) {
+	if d.OnError != nil {
+		d.OnError(err)
+	}
+}
+
+// Resolver looks up DNS records, *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// DNSDiscoverer resolves targets from DNS A/AAAA records or SRV records,
+// and refreshes them every TTL.
+type DNSDiscoverer struct {
+	// Name to look up. A/AAAA records of Name are used if Service is empty,
+	// otherwise SRV records of "_Service._Proto.Name" are used.
+	Name string
+	// Port of targets resolved from A/AAAA records.
+	Port int
+	// Service and Proto of SRV records, such as "http" and "tcp".
+	Service, Proto string
+	// TTL is the interval to refresh records, default is 30s.
+	TTL time.Duration
+	// Resolver to look up records, net.DefaultResolver is used if it's nil.
+	Resolver Resolver
+	// OnError is called when the lookup failed, the last good set of targets is kept.
+	OnError func(err error)
+}
+
+// NewDNSDiscoverer creates a DNSDiscoverer resolves A/AAAA records of host,
+// each address is used with port.
+func NewDNSDiscoverer(host string, port int, ttl time.Duration) *DNSDiscoverer {
+	return &DNSDiscoverer{
+		Name: host,
+		Port: port,
+		TTL:  ttl,
+	}
+}
+
+// NewDNSSRVDiscoverer creates a DNSDiscoverer resolves SRV records of
+// "_service._proto.name", the port and weight of SRV records are used.
+func NewDNSSRVDiscoverer(service, proto, name string, ttl time.Duration) *DNSDiscoverer {
+	return &DNSDiscoverer{
+		Name:    name,
+		Service: service,
+		Proto:   proto,
+		TTL:     ttl,
+	}
+}
+
+// Watch implements Discoverer.
+func (d *DNSDiscoverer) Watch(ctx context.Context, update func(targets []Target)) error {
+	ttl := d.TTL
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+
+	var last []Target
+	for {
+		targets, err := d.lookup(ctx)
+		if err != nil {
+			if d.OnError != nil {
+				d.OnError(err)
+			}
+		} else if last == nil || !reflect.DeepEqual(last, targets) {
+			last = targets
+			update(targets)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *DNSDiscoverer) lookup(ctx context.Context) ([]Target, error) {
+	var resolver Resolver = net.DefaultResolver
+	if d.Resolver != nil {
+		resolver = d.Resolver
+	}
+
+	if d.Service == "" {
+		addrs, err := resolver.LookupHost(ctx, d.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		targets := make([]Target, 0, len(addrs))
+		for _, addr := range addrs {
+			targets = append(targets, Target{Addr: net.JoinHostPort(addr, strconv.Itoa(d.Port))})
+		}
+		return sortTargets(targets), nil
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, d.Service, d.Proto, d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the records with the lowest priority are used, see RFC 2782.
+	var priority uint16
+	for idx, record := range records {
+		if idx == 0 || record.Priority < priority {
+			priority = record.Priority
+		}
+	}
+
+	targets := make([]Target, 0, len(records))
+	for _, record := range records {
+		if record.Priority != priority {
+			continue
+		}
+		targets = append(targets, Target{
+			Addr:   net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))),
+			Weight: int(record.Weight),
+		})
+	}
+	return sortTargets(targets), nil
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// fakeResolver resolves records from memory.
+type fakeResolver struct {
+	mutex sync.Mutex
+	hosts map[string][]string
+	srvs  []*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.hosts[host], r.err
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return "", r.srvs, r.err
+}
+
+func (r *fakeResolver) setHosts(host string, addrs ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hosts = map[string][]string{host: addrs}
+}
+
+// collect runs the Discoverer and sends updates to returned channel.
+func collect(t *testing.T, d Discoverer) <-chan []Target {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	updates := make(chan []Target, 16)
+	go func() {
+		_ = d.Watch(ctx, func(targets []Target) { updates <- targets })
+	}()
+
+	return updates
+}
+
+func receive(t *testing.T, updates <-chan []Target) []Target {
+	t.Helper()
+
+	select {
+	case targets := <-updates:
+		return targets
+	case <-time.After(time.Second):
+		t.Fatal("no update received")
+	}
+	return nil
+}
+
+func Test_StaticDiscoverer(t *testing.T) {
+	updates := collect(t, NewStaticDiscoverer(Target{Addr: "10.0.0.1:80"}, Target{Addr: "10.0.0.2:80", Weight: 2}))
+
+	targets := receive(t, updates)
+	assert.Equal(t, []Target{{Addr: "10.0.0.1:80"}, {Addr: "10.0.0.2:80", Weight: 2}}, targets)
+}
+
+func Test_FileDiscoverer(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "upstreams.json")
+	assert.Nil(t, os.WriteFile(jsonPath, []byte(`[{"addr":"10.0.0.2:80","weight":2},{"addr":"10.0.0.1:80","metadata":{"zone":"a"}}]`), 0o644))
+
+	updates := collect(t, NewFileDiscoverer(jsonPath, 10*time.Millisecond))
+
+	assert.Equal(t, []Target{
+		{Addr: "10.0.0.1:80", Metadata: map[string]string{"zone": "a"}},
+		{Addr: "10.0.0.2:80", Weight: 2},
+	}, receive(t, updates))
+
+	// the file changes
+	assert.Nil(t, os.WriteFile(jsonPath, []byte(`[{"addr":"10.0.0.3:80"}]`), 0o644))
+	assert.Equal(t, []Target{{Addr: "10.0.0.3:80"}}, receive(t, updates))
+
+	yamlPath := filepath.Join(dir, "upstreams.yaml")
+	assert.Nil(t, os.WriteFile(yamlPath, []byte("- addr: 10.0.0.4:80\n  weight: 3\n"), 0o644))
+	assert.Equal(t, []Target{{Addr: "10.0.0.4:80", Weight: 3}}, receive(t, collect(t, NewFileDiscoverer(yamlPath, time.Second))))
+}
+
+func Test_FileDiscoverer_invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstreams.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`not json`), 0o644))
+
+	errs := make(chan error, 1)
+	d := NewFileDiscoverer(path, time.Second)
+	d.OnError = func(err error) { errs <- err }
+	updates := collect(t, d)
+
+	assert.NotNil(t, <-errs)
+	assert.Len(t, updates, 0)
+}
+
+func Test_DNSDiscoverer(t *testing.T) {
+	resolver := &fakeResolver{}
+	resolver.setHosts("backend.local", "10.0.0.2", "10.0.0.1")
+
+	d := NewDNSDiscoverer("backend.local", 8080, 10*time.Millisecond)
+	d.Resolver = resolver
+	updates := collect(t, d)
+
+	assert.Equal(t, []Target{{Addr: "10.0.0.1:8080"}, {Addr: "10.0.0.2:8080"}}, receive(t, updates))
+
+	resolver.setHosts("backend.local", "10.0.0.3")
+	assert.Equal(t, []Target{{Addr: "10.0.0.3:8080"}}, receive(t, updates))
+}
+
+func Test_DNSDiscoverer_SRV(t *testing.T) {
+	resolver := &fakeResolver{srvs: []*net.SRV{
+		{Target: "b.backend.local.", Port: 8081, Priority: 10, Weight: 20},
+		{Target: "a.backend.local.", Port: 8080, Priority: 10, Weight: 10},
+		{Target: "backup.backend.local.", Port: 8080, Priority: 20, Weight: 10},
+	}}
+
+	d := NewDNSSRVDiscoverer("http", "tcp", "backend.local", time.Second)
+	d.Resolver = resolver
+
+	assert.Equal(t, []Target{
+		{Addr: "a.backend.local:8080", Weight: 10},
+		{Addr: "b.backend.local:8081", Weight: 20},
+	}, receive(t, collect(t, d)))
+}
+
+func Test_DNSDiscoverer_error(t *testing.T) {
+	errs := make(chan error, 1)
+	d := NewDNSDiscoverer("backend.local", 8080, time.Second)
+	d.Resolver = &fakeResolver{err: errors.New("lookup failed")}
+	d.OnError = func(err error) { errs <- err }
+	_ = collect(t, d)
+
+	assert.EqualError(t, <-errs, "lookup failed")
+}
+
+func Test_ReverseProxy_WithDiscoverer(t *testing.T) {
+	addr1 := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("1") })
+	addr2 := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("2") })
+
+	path := filepath.Join(t.TempDir(), "upstreams.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"addr":"`+addr1+`","metadata":{"version":"v1"}}]`), 0o644))
+
+	proxy, err := NewReverseProxyWith(WithDiscoverer(NewFileDiscoverer(path, 10*time.Millisecond)))
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	serve := func() string {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		return string(ctx.Response.Body())
+	}
+
+	assert.Eventually(t, func() bool { return serve() == "1" }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]string{"version": "v1"}, proxy.Upstreams()[0].Metadata)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"addr":"`+addr2+`"}]`), 0o644))
+	assert.Eventually(t, func() bool { return serve() == "2" }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(proxy.Upstreams()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func Test_ReverseProxy_SetUpstreams(t *testing.T) {
+	proxy, err := NewReverseProxyWith(WithBalancer(map[string]Weight{"10.0.0.1:80": 1, "10.0.0.2:80": 1}))
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	proxy.SetUpstreams([]Target{{Addr: "10.0.0.2:80", Weight: 5}, {Addr: "10.0.0.3:80"}})
+
+	assert.Eventually(t, func() bool { return len(proxy.Upstreams()) == 2 }, time.Second, 10*time.Millisecond)
+	stats := proxy.Upstreams()
+	assert.Equal(t, 5, findStats(stats, "10.0.0.2:80").Weight)
+	assert.Equal(t, 1, findStats(stats, "10.0.0.3:80").Weight)
+}
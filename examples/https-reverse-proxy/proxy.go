@@ -3,27 +3,28 @@ package main
 import (
 	"log"
 
-	"github.com/valyala/fasthttp"
-
 	proxy "github.com/yeqown/fasthttp-reverse-proxy/v2"
 )
 
-var (
-	proxyServer, _ = proxy.NewReverseProxyWith(
-		proxy.WithAddress("localhost:8080"),
-		proxy.WithTLS("./selfsigned.crt", "./selfsigned.key"),
+func main() {
+	proxyServer, err := proxy.NewReverseProxyWith(
+		proxy.WithAddress("https://127.0.0.1:8080"),
+		// trust the self-signed certificate of upstream server, it's issued for 127.0.0.1.
+		proxy.WithUpstreamRootCAs("./selfsigned.crt"),
 	)
-)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-// ProxyHandler ... fasthttp.RequestHandler func
-func ProxyHandler(ctx *fasthttp.RequestCtx) {
-	requestURI := string(ctx.RequestURI())
-	log.Printf("a request incoming, requestURI=%s\n", requestURI)
-	proxyServer.ServeHTTP(ctx)
-}
+	// terminate TLS with the same self-signed certificate, it's reloaded
+	// when the files are changed or the process receives SIGHUP.
+	server := proxy.NewTLSServer(proxyServer, proxy.CertFile{
+		CertFile: "./selfsigned.crt",
+		KeyFile:  "./selfsigned.key",
+	})
+	server.ReloadOnSIGHUP = true
 
-func main() {
-	if err := fasthttp.ListenAndServe("0.0.0.0:8081", ProxyHandler); err != nil {
+	if err := server.ListenAndServe("0.0.0.0:8081"); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ForwardedHeader is a set of headers carrying the information of client.
+type ForwardedHeader uint8
+
+const (
+	// HeaderForwarded is the Forwarded header defined by RFC 7239.
+	HeaderForwarded ForwardedHeader = 1 << iota
+	// HeaderXForwardedFor is the X-Forwarded-For header.
+	HeaderXForwardedFor
+	// HeaderXForwardedProto is the X-Forwarded-Proto header.
+	HeaderXForwardedProto
+	// HeaderXForwardedHost is the X-Forwarded-Host header.
+	HeaderXForwardedHost
+	// HeaderXForwardedPort is the X-Forwarded-Port header.
+	HeaderXForwardedPort
+	// HeaderXRealIP is the X-Real-IP header.
+	HeaderXRealIP
+
+	// HeaderXForwardedAll is all the X-Forwarded-* headers.
+	HeaderXForwardedAll = HeaderXForwardedFor | HeaderXForwardedProto | HeaderXForwardedHost | HeaderXForwardedPort
+)
+
+// _forwardedHeaders are the names of ForwardedHeader in order.
+var _forwardedHeaders = []struct {
+	header ForwardedHeader
+	name   string
+}{
+	{HeaderForwarded, "Forwarded"},
+	{HeaderXForwardedFor, "X-Forwarded-For"},
+	{HeaderXForwardedProto, "X-Forwarded-Proto"},
+	{HeaderXForwardedHost, "X-Forwarded-Host"},
+	{HeaderXForwardedPort, "X-Forwarded-Port"},
+	{HeaderXRealIP, "X-Real-IP"},
+}
+
+// ForwardedMode decides how the forwarded headers of request are generated.
+type ForwardedMode uint8
+
+const (
+	// ForwardedAppend appends the client to the headers from trusted proxies,
+	// the headers from untrusted clients are dropped.
+	ForwardedAppend ForwardedMode = iota
+	// ForwardedOverwrite drops the headers of request and generates them with
+	// the client only.
+	ForwardedOverwrite
+	// ForwardedStrip drops the headers of request and generates nothing.
+	ForwardedStrip
+)
+
+// ForwardedHeaders configures the headers carrying the information of client,
+// which are sent to upstream.
+type ForwardedHeaders struct {
+	// Headers to generate, default is HeaderXForwardedFor.
+	Headers ForwardedHeader
+	// Mode of generating, default is ForwardedAppend.
+	Mode ForwardedMode
+	// TrustedProxies are the IPs or CIDRs of proxies in front of ReverseProxy,
+	// the forwarded headers of requests from other clients are considered as
+	// spoofed and dropped. All the forwarded headers are dropped, including
+	// the ones not in Headers.
+	TrustedProxies []string
+
+	trusted []*net.IPNet
+}
+
+// parse parses TrustedProxies and fills the zero fields with default values.
+func (fh ForwardedHeaders) parse() (ForwardedHeaders, error) {
+	if fh.Headers == 0 {
+		fh.Headers = HeaderXForwardedFor
+	}
+
+	fh.trusted = make([]*net.IPNet, 0, len(fh.TrustedProxies))
+	for _, proxy := range fh.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fh, err
+		}
+		fh.trusted = append(fh.trusted, ipNet)
+	}
+
+	return fh, nil
+}
+
+// defaultForwardedHeaders appends X-Forwarded-For to the one from any client,
+// which is the behavior of previous versions.
+func defaultForwardedHeaders() *ForwardedHeaders {
+	fh, _ := ForwardedHeaders{TrustedProxies: []string{"0.0.0.0/0", "::/0"}}.parse()
+	return &fh
+}
+
+// isTrusted reports whether ip is a trusted proxy.
+func (fh *ForwardedHeaders) isTrusted(ip net.IP) bool {
+	for _, ipNet := range fh.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply generates the forwarded headers of the request in ctx.
+func (fh *ForwardedHeaders) apply(ctx *fasthttp.RequestCtx) {
+	h := &ctx.Request.Header
+	ip := ctx.RemoteIP()
+
+	keep := fh.Mode == ForwardedAppend && fh.isTrusted(ip)
+	prior := make(map[string]string, len(_forwardedHeaders))
+	for _, fw := range _forwardedHeaders {
+		if keep {
+			// fold multiple header lines into one.
+			if values := h.PeekAll(fw.name); len(values) != 0 {
+				prior[fw.name] = string(bytes.Join(values, []byte(", ")))
+			}
+		}
+		h.Del(fw.name)
+	}
+
+	if fh.Mode == ForwardedStrip {
+		return
+	}
+
+	proto := "http"
+	if ctx.IsTLS() {
+		proto = "https"
+	}
+	host := string(ctx.Request.Host())
+	clientIP := ""
+	if len(ip) != 0 && !ip.IsUnspecified() {
+		clientIP = ip.String()
+	}
+
+	for _, fw := range _forwardedHeaders {
+		value, ok := prior[fw.name]
+		if fh.Headers&fw.header == 0 {
+			// not generated, keep the one from trusted proxies.
+			if ok {
+				h.Set(fw.name, value)
+			}
+			continue
+		}
+
+		switch fw.header {
+		case HeaderForwarded:
+			value = appendValue(value, forwardedElement(clientIP, host, proto))
+		case HeaderXForwardedFor:
+			if clientIP != "" {
+				value = appendValue(value, clientIP)
+			}
+		case HeaderXForwardedProto:
+			if !ok {
+				value = proto
+			}
+		case HeaderXForwardedHost:
+			if !ok {
+				value = host
+			}
+		case HeaderXForwardedPort:
+			if !ok {
+				value = localPort(ctx, proto)
+			}
+		case HeaderXRealIP:
+			if !ok {
+				value = clientIP
+			}
+		}
+
+		if value != "" {
+			h.Set(fw.name, value)
+		}
+	}
+}
+
+// appendValue appends value to the comma separated list.
+func appendValue(list, value string) string {
+	if list == "" {
+		return value
+	}
+
+	return list + ", " + value
+}
+
+// forwardedElement formats the forwarded-element of RFC 7239.
+func forwardedElement(clientIP, host, proto string) string {
+	var b strings.Builder
+	b.WriteString("for=")
+	switch {
+	case clientIP == "":
+		b.WriteString("unknown")
+	case strings.Contains(clientIP, ":"):
+		// IPv6 must be bracketed and quoted.
+		b.WriteString(`"[` + clientIP + `]"`)
+	default:
+		b.WriteString(clientIP)
+	}
+
+	if host != "" {
+		b.WriteString(";host=")
+		b.WriteString(quoteForwarded(host))
+	}
+	b.WriteString(";proto=")
+	b.WriteString(proto)
+
+	return b.String()
+}
+
+// quoteForwarded quotes value if it's not a token of RFC 7230.
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return strconv.Quote(value)
+		}
+	}
+
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// localPort returns the port which the client connected to.
+func localPort(ctx *fasthttp.RequestCtx, proto string) string {
+	if addr, ok := ctx.LocalAddr().(*net.TCPAddr); ok && addr.Port != 0 {
+		return strconv.Itoa(addr.Port)
+	}
+
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
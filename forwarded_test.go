@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_ForwardedHeaders_apply(t *testing.T) {
+	all := HeaderForwarded | HeaderXForwardedAll | HeaderXRealIP
+	spoofed := map[string][]string{
+		"X-Forwarded-For":   {"1.1.1.1", "2.2.2.2"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Real-IP":         {"1.1.1.1"},
+		"Forwarded":         {"for=1.1.1.1"},
+	}
+
+	testCases := []struct {
+		desc    string
+		fh      ForwardedHeaders
+		remote  net.IP
+		headers map[string][]string
+		want    map[string]string
+	}{
+		{
+			desc:    "default appends and folds",
+			remote:  net.IPv4(10, 0, 0, 1),
+			headers: spoofed,
+			want: map[string]string{
+				"X-Forwarded-For":   "1.1.1.1, 2.2.2.2, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Real-IP":         "1.1.1.1",
+				"Forwarded":         "for=1.1.1.1",
+			},
+		},
+		{
+			desc:    "untrusted client",
+			fh:      ForwardedHeaders{Headers: all, TrustedProxies: []string{"192.168.0.0/16"}},
+			remote:  net.IPv4(10, 0, 0, 1),
+			headers: spoofed,
+			want: map[string]string{
+				"X-Forwarded-For":   "10.0.0.1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com:8080",
+				"X-Forwarded-Port":  "80",
+				"X-Real-IP":         "10.0.0.1",
+				"Forwarded":         `for=10.0.0.1;host="example.com:8080";proto=http`,
+			},
+		},
+		{
+			desc:    "trusted proxy",
+			fh:      ForwardedHeaders{Headers: all, TrustedProxies: []string{"10.0.0.1"}},
+			remote:  net.IPv4(10, 0, 0, 1),
+			headers: spoofed,
+			want: map[string]string{
+				"X-Forwarded-For":   "1.1.1.1, 2.2.2.2, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "example.com:8080",
+				"X-Forwarded-Port":  "80",
+				"X-Real-IP":         "1.1.1.1",
+				"Forwarded":         `for=1.1.1.1, for=10.0.0.1;host="example.com:8080";proto=http`,
+			},
+		},
+		{
+			desc:    "untrusted client drops headers not generated",
+			fh:      ForwardedHeaders{TrustedProxies: []string{"192.168.0.0/16"}},
+			remote:  net.IPv4(10, 0, 0, 1),
+			headers: spoofed,
+			want:    map[string]string{"X-Forwarded-For": "10.0.0.1"},
+		},
+		{
+			desc:    "overwrite",
+			fh:      ForwardedHeaders{Headers: HeaderForwarded | HeaderXForwardedFor, Mode: ForwardedOverwrite, TrustedProxies: []string{"0.0.0.0/0"}},
+			remote:  net.ParseIP("2001:db8::1"),
+			headers: spoofed,
+			want: map[string]string{
+				"X-Forwarded-For": "2001:db8::1",
+				"Forwarded":       `for="[2001:db8::1]";host="example.com:8080";proto=http`,
+			},
+		},
+		{
+			desc:    "strip",
+			fh:      ForwardedHeaders{Headers: all, Mode: ForwardedStrip},
+			remote:  net.IPv4(10, 0, 0, 1),
+			headers: spoofed,
+			want:    map[string]string{},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			fh := defaultForwardedHeaders()
+			if tC.fh.Headers != 0 || tC.fh.TrustedProxies != nil || tC.fh.Mode != ForwardedAppend {
+				parsed, err := tC.fh.parse()
+				assert.Nil(t, err)
+				fh = &parsed
+			}
+
+			req := &fasthttp.Request{}
+			req.SetRequestURI("http://example.com:8080/")
+			for name, values := range tC.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(req, &net.TCPAddr{IP: tC.remote, Port: 12345}, nil)
+
+			fh.apply(ctx)
+
+			got := make(map[string]string)
+			for _, fw := range _forwardedHeaders {
+				values := ctx.Request.Header.PeekAll(fw.name)
+				assert.LessOrEqual(t, len(values), 1, fw.name)
+				if len(values) == 1 {
+					got[fw.name] = string(values[0])
+				}
+			}
+			assert.Equal(t, tC.want, got)
+		})
+	}
+}
+
+func Test_WithForwardedHeaders(t *testing.T) {
+	_, err := NewReverseProxyWith(WithAddress("localhost:8080"), WithForwardedHeaders(ForwardedHeaders{
+		TrustedProxies: []string{"10.0.0.0/33"},
+	}))
+	assert.NotNil(t, err)
+
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBody(ctx.Request.Header.Peek("X-Forwarded-For"))
+	})
+	proxy, err := NewReverseProxyWith(WithAddress(addr), WithForwardedHeaders(ForwardedHeaders{
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}))
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	ctx.Request.Header.Add("X-Forwarded-For", "1.1.1.1")
+	ctx.Request.Header.Add("X-Forwarded-For", "2.2.2.2")
+	proxy.ServeHTTP(ctx)
+	assert.Equal(t, "1.1.1.1, 2.2.2.2, 10.0.0.1", string(ctx.Response.Body()))
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HealthCheck configures active health checking of upstream servers. Each
+// upstream is probed periodically with an HTTP GET request, the upstream
+// will be removed from balancer after Fall consecutive failures, and be
+// added back after Rise consecutive successes.
+type HealthCheck struct {
+	// Path is the request path of probe, default is "/".
+	Path string
+	// Interval between two probes, default is 10s.
+	Interval time.Duration
+	// Timeout of each probe, default is 2s.
+	Timeout time.Duration
+	// ExpectedStatus is the status code which means healthy,
+	// any 2xx status code is accepted if it's 0.
+	ExpectedStatus int
+	// Rise is the number of consecutive successes to mark an upstream healthy, default is 2.
+	Rise int
+	// Fall is the number of consecutive failures to mark an upstream unhealthy, default is 3.
+	Fall int
+}
+
+// withDefaults fills the zero fields with default values.
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = 2
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = 3
+	}
+
+	return hc
+}
+
+// healthy reports whether the status code of probe response is expected.
+func (hc HealthCheck) healthy(statusCode int) bool {
+	if hc.ExpectedStatus == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+
+	return statusCode == hc.ExpectedStatus
+}
+
+// healthState counts the consecutive results of probes to an upstream.
+type healthState struct {
+	successes int
+	failures  int
+}
+
+// runHealthCheck probes all upstreams every interval until ReverseProxy is closed.
+func (p *ReverseProxy) runHealthCheck(hc *HealthCheck) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	states := make(map[*upstream]*healthState)
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mutex.RLock()
+		upstreams := make([]*upstream, len(p.upstreams))
+		copy(upstreams, p.upstreams)
+		p.mutex.RUnlock()
+
+		var (
+			wg      sync.WaitGroup
+			results = make([]bool, len(upstreams))
+		)
+		for idx, u := range upstreams {
+			wg.Add(1)
+			go func(idx int, u *upstream) {
+				defer wg.Done()
+				results[idx] = p.probe(u, hc)
+			}(idx, u)
+		}
+		wg.Wait()
+
+		changed := false
+		alive := make(map[*upstream]*healthState, len(upstreams))
+		for idx, u := range upstreams {
+			state, ok := states[u]
+			if !ok {
+				state = &healthState{}
+			}
+			alive[u] = state
+
+			if p.updateHealth(u, state, results[idx], hc) {
+				changed = true
+			}
+		}
+		// forget the upstreams those have been removed.
+		states = alive
+
+		if changed {
+			p.mutex.Lock()
+			p.rebuild()
+			p.mutex.Unlock()
+		}
+	}
+}
+
+// updateHealth records the result of probe, and marks the upstream healthy
+// or unhealthy if thresholds are reached. It returns true if upstream's
+// health has been changed.
+func (p *ReverseProxy) updateHealth(u *upstream, state *healthState, ok bool, hc *HealthCheck) bool {
+	if ok {
+		state.successes++
+		state.failures = 0
+		if u.unhealthy.Load() && state.successes >= hc.Rise {
+			u.unhealthy.Store(false)
+			debugF(p.opt.debug, p.opt.logger, "health check: upstream %s becomes healthy", u.Addr)
+			return true
+		}
+
+		return false
+	}
+
+	state.failures++
+	state.successes = 0
+	if !u.unhealthy.Load() && state.failures >= hc.Fall {
+		u.unhealthy.Store(true)
+		errorF(p.opt.logger, "health check: upstream %s becomes unhealthy", u.Addr)
+		return true
+	}
+
+	return false
+}
+
+// probe sends a health check request to upstream.
+func (p *ReverseProxy) probe(u *upstream, hc *HealthCheck) bool {
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(res)
+	}()
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(hc.Path)
+	req.SetHost(u.Addr)
+	if u.IsTLS {
+		req.URI().SetScheme("https")
+	}
+
+	if err := u.DoTimeout(req, res, hc.Timeout); err != nil {
+		debugF(p.opt.debug, p.opt.logger, "health check: probe %s failed, err = %v", u.Addr, err)
+		return false
+	}
+
+	return hc.healthy(res.StatusCode())
+}
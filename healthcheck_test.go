@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_HealthCheck_withDefaults(t *testing.T) {
+	hc := HealthCheck{}.withDefaults()
+
+	assert.Equal(t, "/", hc.Path)
+	assert.Equal(t, 10*time.Second, hc.Interval)
+	assert.Equal(t, 2*time.Second, hc.Timeout)
+	assert.Equal(t, 2, hc.Rise)
+	assert.Equal(t, 3, hc.Fall)
+
+	assert.True(t, hc.healthy(fasthttp.StatusNoContent))
+	assert.False(t, hc.healthy(fasthttp.StatusServiceUnavailable))
+
+	hc.ExpectedStatus = fasthttp.StatusTeapot
+	assert.True(t, hc.healthy(fasthttp.StatusTeapot))
+	assert.False(t, hc.healthy(fasthttp.StatusOK))
+}
+
+func Test_ReverseProxy_WithHealthCheck(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+
+	healthyAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("healthy")
+	})
+	brokenAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		if broken.Load() && string(ctx.Path()) == "/health" {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			return
+		}
+		ctx.SetBodyString("broken")
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{healthyAddr: 1, brokenAddr: 1}),
+		WithHealthCheck(HealthCheck{
+			Path:     "/health",
+			Interval: 10 * time.Millisecond,
+			Rise:     1,
+			Fall:     1,
+		}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	serve := func() string {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		return string(ctx.Response.Body())
+	}
+
+	assert.Eventually(t, func() bool {
+		for i := 0; i < 10; i++ {
+			if serve() != "healthy" {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 20*time.Millisecond)
+
+	broken.Store(false)
+	assert.Eventually(t, func() bool {
+		for i := 0; i < 10; i++ {
+			if serve() == "broken" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 20*time.Millisecond)
+}
+
+func Test_ReverseProxy_WithHealthCheck_allUnhealthy(t *testing.T) {
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithAddress(addr),
+		WithHealthCheck(HealthCheck{Interval: 10 * time.Millisecond, Fall: 1}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	assert.Eventually(t, func() bool {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		return ctx.Response.StatusCode() == fasthttp.StatusServiceUnavailable
+	}, time.Second, 20*time.Millisecond)
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// _hedgeSamples is the number of recent latencies kept to calculate percentile.
+	_hedgeSamples = 256
+	// _hedgeMinSamples is the minimum number of latencies to use percentile,
+	// and the percentile is recalculated every _hedgeMinSamples latencies.
+	_hedgeMinSamples = 32
+	// _hedgeBudgetBurst is the max number of hedged requests could be saved up.
+	_hedgeBudgetBurst = 10
+)
+
+// Hedging configures hedged requests for latency-sensitive routes. If the
+// upstream has not responded in Delay, a copy of the request is sent to
+// another upstream, and the response comes first wins, the other one is
+// dropped. Only idempotent requests, or requests with Idempotency-Key header,
+// are hedged.
+type Hedging struct {
+	// Delay to wait before sending the hedged request, default is 100ms. It's
+	// also used before enough latencies are observed if Percentile is set.
+	Delay time.Duration
+	// Percentile in (0, 100) of recent latencies to wait instead of Delay,
+	// such as 95. Delay is used if it's 0.
+	Percentile float64
+	// BudgetRatio in (0, 1] limits the hedged requests to the ratio of all
+	// hedgeable requests, so that the load is not doubled when upstreams are
+	// slow, default is 0.1.
+	BudgetRatio float64
+	// MaxBodySize is the max size of request body could be hedged, default is 64KB.
+	MaxBodySize int
+}
+
+// withDefaults fills the zero fields with default values.
+func (h Hedging) withDefaults() Hedging {
+	if h.Delay <= 0 {
+		h.Delay = 100 * time.Millisecond
+	}
+	if h.Percentile < 0 || h.Percentile >= 100 {
+		h.Percentile = 0
+	}
+	if h.BudgetRatio <= 0 || h.BudgetRatio > 1 {
+		h.BudgetRatio = 0.1
+	}
+	if h.MaxBodySize <= 0 {
+		h.MaxBodySize = 64 * 1024
+	}
+
+	return h
+}
+
+// hedger keeps the budget and recent latencies of hedging.
+type hedger struct {
+	Hedging
+
+	mutex sync.Mutex
+	// tokens is the budget of hedged requests, each hedgeable request deposits
+	// BudgetRatio and each hedged request withdraws 1.
+	tokens float64
+	// samples is the ring of recent latencies, and next is the index to write.
+	samples []time.Duration
+	next    int
+	// observed is the number of latencies since percentile was calculated.
+	observed  int
+	threshold time.Duration
+}
+
+func newHedger(h Hedging) *hedger {
+	return &hedger{
+		Hedging: h.withDefaults(),
+		tokens:  _hedgeBudgetBurst,
+		samples: make([]time.Duration, 0, _hedgeSamples),
+	}
+}
+
+// allowRequest reports whether the request could be hedged.
+func (h *hedger) allowRequest(req *fasthttp.Request) bool {
+	if !isIdempotent(req) {
+		return false
+	}
+
+	return bufferableBody(req, h.MaxBodySize)
+}
+
+// deposit saves the budget for a hedgeable request.
+func (h *hedger) deposit() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.tokens += h.BudgetRatio
+	if h.tokens > _hedgeBudgetBurst {
+		h.tokens = _hedgeBudgetBurst
+	}
+}
+
+// withdraw reports whether there is budget for a hedged request.
+func (h *hedger) withdraw() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// refund gives back the budget withdrawn by a hedged request not sent.
+func (h *hedger) refund() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.tokens++
+}
+
+// observe records the latency of a succeeded request.
+func (h *hedger) observe(latency time.Duration) {
+	if h.Percentile == 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.samples) < _hedgeSamples {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+	}
+	h.next = (h.next + 1) % _hedgeSamples
+
+	// sorting is not cheap, recalculate the percentile in batch.
+	if h.observed++; h.observed >= _hedgeMinSamples {
+		h.observed = 0
+		sorted := append([]time.Duration(nil), h.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		h.threshold = sorted[int(float64(len(sorted)-1)*h.Percentile/100)]
+	}
+}
+
+// delay returns the time to wait before sending the hedged request.
+func (h *hedger) delay() time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.threshold > 0 {
+		return h.threshold
+	}
+	return h.Delay
+}
+
+// hedgeResult is the result of a request sent by doHedged.
+type hedgeResult struct {
+	pick
+	req *fasthttp.Request
+	res *fasthttp.Response
+	err error
+}
+
+func (r *hedgeResult) release() {
+	fasthttp.ReleaseRequest(r.req)
+	fasthttp.ReleaseResponse(r.res)
+}
+
+// doHedged sends a copy of req to the picked upstream, and another copy to the
+// next upstream if it has not responded in the delay of hedging. The response
+// comes first is copied into res, and the upstream sent to is returned. The
+// loser is not interrupted since HostClient could not cancel a request, its
+// response is dropped once it's done.
+func (p *ReverseProxy) doHedged(ctx *fasthttp.RequestCtx, first pick, req *fasthttp.Request,
+	res *fasthttp.Response, tried *[]*upstream) (*upstream, error) {
+	h := p.opt.hedging
+	h.deposit()
+
+	results := make(chan *hedgeResult, 2)
+	send := func(pk pick) {
+		r := &hedgeResult{pick: pk, req: fasthttp.AcquireRequest(), res: fasthttp.AcquireResponse()}
+		req.CopyTo(r.req)
+		// the loser may be still running after ServeHTTP returns, Close waits for it.
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			r.err = p.send(pk, r.req, r.res)
+			results <- r
+		}()
+	}
+
+	send(first)
+	pending := 1
+
+	timer := time.NewTimer(h.delay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err != nil && pending > 0 {
+				// wait for the other one.
+				r.release()
+				continue
+			}
+
+			if pending > 0 {
+				go func() {
+					loser := <-results
+					loser.release()
+				}()
+			}
+
+			r.req.CopyTo(req)
+			r.res.CopyTo(res)
+			r.release()
+			return r.u, r.err
+		case <-timer.C:
+			if !h.withdraw() {
+				debugF(p.opt.debug, p.opt.logger, "hedging budget exhausted, addr = %s", first.u.Addr)
+				continue
+			}
+
+			second, err := p.pickUpstream(ctx, tried)
+			if err != nil || second.u == nil {
+				h.refund()
+				continue
+			}
+
+			debugF(p.opt.debug, p.opt.logger, "hedge request, addr = %s, hedged addr = %s", first.u.Addr, second.u.Addr)
+			send(second)
+			pending++
+		}
+	}
+}
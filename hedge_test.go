@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_hedger_allowRequest(t *testing.T) {
+	h := newHedger(Hedging{MaxBodySize: 4})
+
+	testCases := []struct {
+		desc    string
+		method  string
+		header  string
+		body    string
+		allowed bool
+	}{
+		{desc: "get", method: fasthttp.MethodGet, allowed: true},
+		{desc: "post", method: fasthttp.MethodPost, allowed: false},
+		{desc: "post with idempotency key", method: fasthttp.MethodPost, header: "Idempotency-Key", allowed: true},
+		{desc: "body too large", method: fasthttp.MethodPut, body: "too large", allowed: false},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			req.Header.SetMethod(tC.method)
+			if tC.header != "" {
+				req.Header.Set(tC.header, "1")
+			}
+			req.SetBodyString(tC.body)
+
+			assert.Equal(t, tC.allowed, h.allowRequest(req))
+		})
+	}
+}
+
+func Test_hedger_budget(t *testing.T) {
+	h := newHedger(Hedging{BudgetRatio: 0.5})
+	for i := 0; i < _hedgeBudgetBurst; i++ {
+		assert.True(t, h.withdraw())
+	}
+	assert.False(t, h.withdraw())
+
+	h.deposit()
+	assert.False(t, h.withdraw())
+	h.deposit()
+	assert.True(t, h.withdraw())
+
+	h.refund()
+	assert.True(t, h.withdraw())
+
+	// the saved budget is capped.
+	for i := 0; i < 100; i++ {
+		h.deposit()
+	}
+	assert.Equal(t, float64(_hedgeBudgetBurst), h.tokens)
+}
+
+func Test_hedger_delay(t *testing.T) {
+	h := newHedger(Hedging{Delay: time.Second})
+	h.observe(time.Millisecond)
+	assert.Equal(t, time.Second, h.delay())
+
+	h = newHedger(Hedging{Delay: time.Second, Percentile: 90})
+	for i := 1; i < _hedgeMinSamples; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	// not enough samples.
+	assert.Equal(t, time.Second, h.delay())
+
+	h.observe(_hedgeMinSamples * time.Millisecond)
+	assert.Equal(t, 28*time.Millisecond, h.delay())
+}
+
+func Test_ReverseProxy_WithHedging(t *testing.T) {
+	slowAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(300 * time.Millisecond)
+		ctx.SetBodyString("slow")
+	})
+	fastAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("fast")
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{slowAddr: 1, fastAddr: 1}),
+		WithHedging(Hedging{Delay: 20 * time.Millisecond}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	serve := func(method string) (string, time.Duration) {
+		ctx := newTestRequestCtx(method, "http://example.com/")
+		start := time.Now()
+		proxy.ServeHTTP(ctx)
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+		return string(ctx.Response.Body()), time.Since(start)
+	}
+
+	// the hedged request to fast upstream wins.
+	for i := 0; i < 4; i++ {
+		body, elapsed := serve(fasthttp.MethodGet)
+		assert.Equal(t, "fast", body)
+		assert.Less(t, elapsed, 200*time.Millisecond)
+	}
+
+	// non-idempotent requests are not hedged.
+	bodies := map[string]int{}
+	for i := 0; i < 2; i++ {
+		body, _ := serve(fasthttp.MethodPost)
+		bodies[body]++
+	}
+	assert.Equal(t, map[string]int{"slow": 1, "fast": 1}, bodies)
+
+	// no more hedged requests if budget is exhausted.
+	proxy.opt.hedging.tokens = 0
+	bodies = map[string]int{}
+	for i := 0; i < 2; i++ {
+		body, _ := serve(fasthttp.MethodGet)
+		bodies[body]++
+	}
+	assert.Equal(t, map[string]int{"slow": 1, "fast": 1}, bodies)
+}
+
+func Test_WithHedging_reused(t *testing.T) {
+	option := WithHedging(Hedging{})
+	proxy1, err := NewReverseProxyWith(WithAddress("localhost:8080"), option)
+	assert.Nil(t, err)
+	defer proxy1.Close()
+	proxy2, err := NewReverseProxyWith(WithAddress("localhost:8081"), option)
+	assert.Nil(t, err)
+	defer proxy2.Close()
+
+	// the budget is not shared by the proxies built with the same Option.
+	assert.NotSame(t, proxy1.opt.hedging, proxy2.opt.hedging)
+	for proxy1.opt.hedging.withdraw() {
+	}
+	assert.True(t, proxy2.opt.hedging.withdraw())
+}
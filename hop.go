@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+
+	"github.com/valyala/fasthttp"
+)
+
+// hopHeader is implemented by fasthttp.RequestHeader and fasthttp.ResponseHeader.
+type hopHeader interface {
+	PeekAll(key string) [][]byte
+	Set(key, value string)
+	Del(key string)
+}
+
+var (
+	_ hopHeader = (*fasthttp.RequestHeader)(nil)
+	_ hopHeader = (*fasthttp.ResponseHeader)(nil)
+)
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones listed
+// in the Connection header as RFC 7230 section 6.1 requires.
+func removeHopHeaders(h hopHeader) {
+	for _, value := range h.PeekAll(fasthttp.HeaderConnection) {
+		for _, token := range bytes.Split(value, []byte(",")) {
+			if token = bytes.TrimSpace(token); len(token) != 0 {
+				h.Del(string(token))
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// containsToken reports whether token is in the comma separated values,
+// it's case-insensitive.
+func containsToken(values [][]byte, token string) bool {
+	for _, value := range values {
+		for _, t := range bytes.Split(value, []byte(",")) {
+			if bytes.EqualFold(bytes.TrimSpace(t), []byte(token)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// addVia appends the proxy to the Via header, protocol is the version of
+// HTTP received by proxy.
+func addVia(h hopHeader, http11 bool, pseudonym string) {
+	if pseudonym == "" {
+		return
+	}
+
+	received := "1.0 " + pseudonym
+	if http11 {
+		received = "1.1 " + pseudonym
+	}
+
+	if values := h.PeekAll(fasthttp.HeaderVia); len(values) != 0 {
+		received = string(bytes.Join(values, []byte(", "))) + ", " + received
+	}
+	h.Set(fasthttp.HeaderVia, received)
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_removeHopHeaders(t *testing.T) {
+	// multiple Connection lines are kept only when the header is parsed.
+	raw := "GET / HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Connection: keep-alive, X-Secret\r\n" +
+		"Connection: x-other\r\n" +
+		"X-Secret: 1\r\n" +
+		"X-Other: 1\r\n" +
+		"X-Kept: 1\r\n" +
+		"Keep-Alive: timeout=5\r\n" +
+		"Proxy-Authorization: Basic Zm9vOmJhcg==\r\n" +
+		"Upgrade: h2c\r\n" +
+		"TE: trailers\r\n" +
+		"\r\n"
+	h := &fasthttp.RequestHeader{}
+	assert.Nil(t, h.Read(bufio.NewReader(strings.NewReader(raw))))
+
+	removeHopHeaders(h)
+
+	for _, name := range []string{"Connection", "X-Secret", "X-Other", "Keep-Alive", "Proxy-Authorization", "Upgrade", "TE"} {
+		assert.Nil(t, h.Peek(name), name)
+	}
+	assert.Equal(t, "1", string(h.Peek("X-Kept")))
+}
+
+func Test_containsToken(t *testing.T) {
+	assert.True(t, containsToken([][]byte{[]byte("gzip, Trailers")}, "trailers"))
+	assert.True(t, containsToken([][]byte{[]byte("gzip"), []byte("trailers")}, "trailers"))
+	assert.False(t, containsToken([][]byte{[]byte("gzip, trailersx")}, "trailers"))
+	assert.False(t, containsToken(nil, "trailers"))
+}
+
+func Test_addVia(t *testing.T) {
+	h := &fasthttp.ResponseHeader{}
+	addVia(h, true, "")
+	assert.Nil(t, h.Peek("Via"))
+
+	addVia(h, false, "proxy-a")
+	assert.Equal(t, "1.0 proxy-a", string(h.Peek("Via")))
+
+	addVia(h, true, "proxy-b")
+	assert.Equal(t, "1.0 proxy-a, 1.1 proxy-b", string(h.Peek("Via")))
+}
+
+// Test_ReverseProxy_HopHeaders checks the hop-by-hop processing of RFC 7230
+// section 6.1 in both directions.
+func Test_ReverseProxy_HopHeaders(t *testing.T) {
+	var received fasthttp.RequestHeader
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Request.Header.CopyTo(&received)
+
+		ctx.Response.Header.Set("Connection", "X-Upstream-Secret")
+		ctx.Response.Header.Set("X-Upstream-Secret", "1")
+		ctx.Response.Header.Set("Proxy-Authenticate", "Basic")
+		ctx.Response.Header.Set("X-Upstream-Kept", "1")
+		ctx.Response.Header.Set("Via", "1.1 upstream")
+	})
+
+	testCases := []struct {
+		desc    string
+		options []Option
+		headers map[string]string
+		want    map[string]string
+		absent  []string
+		resVia  string
+	}{
+		{
+			desc: "connection tokens",
+			headers: map[string]string{
+				"Connection":      "X-Client-Secret, keep-alive",
+				"X-Client-Secret": "1",
+				"Keep-Alive":      "timeout=5",
+				"X-Client-Kept":   "1",
+			},
+			want:   map[string]string{"X-Client-Kept": "1"},
+			absent: []string{"X-Client-Secret", "Keep-Alive", "Via"},
+			resVia: "1.1 upstream",
+		},
+		{
+			desc:    "te trailers",
+			headers: map[string]string{"TE": "gzip, trailers"},
+			want:    map[string]string{"TE": "trailers"},
+		},
+		{
+			desc:    "te without trailers",
+			headers: map[string]string{"TE": "gzip"},
+			absent:  []string{"TE"},
+		},
+		{
+			desc:    "te listed in connection",
+			headers: map[string]string{"TE": "trailers", "Connection": "TE"},
+			want:    map[string]string{"TE": "trailers"},
+		},
+		{
+			desc:    "via",
+			options: []Option{WithVia("edge")},
+			headers: map[string]string{"Via": "1.0 client-proxy"},
+			want:    map[string]string{"Via": "1.0 client-proxy, 1.1 edge"},
+			resVia:  "1.1 upstream, 1.1 edge",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			proxy, err := NewReverseProxyWith(append([]Option{WithAddress(addr)}, tC.options...)...)
+			assert.Nil(t, err)
+			defer proxy.Close()
+
+			ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+			for name, value := range tC.headers {
+				ctx.Request.Header.Set(name, value)
+			}
+			proxy.ServeHTTP(ctx)
+			assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+			for name, value := range tC.want {
+				assert.Equal(t, value, string(received.Peek(name)), name)
+			}
+			for _, name := range tC.absent {
+				assert.Nil(t, received.Peek(name), name)
+			}
+
+			res := &ctx.Response.Header
+			assert.Nil(t, res.Peek("X-Upstream-Secret"))
+			assert.Nil(t, res.Peek("Proxy-Authenticate"))
+			assert.Equal(t, "1", string(res.Peek("X-Upstream-Kept")))
+			if tC.resVia != "" {
+				assert.Equal(t, tC.resVia, string(res.Peek("Via")))
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+// KeyFunc extracts a key from the request, such as a header, a cookie or the
+// client IP. Empty key means the key is absent in the request.
+type KeyFunc func(ctx *fasthttp.RequestCtx) []byte
+
+// HeaderKey returns a KeyFunc which takes the value of request header name as key.
+func HeaderKey(name string) KeyFunc {
+	return func(ctx *fasthttp.RequestCtx) []byte {
+		return ctx.Request.Header.Peek(name)
+	}
+}
+
+// CookieKey returns a KeyFunc which takes the value of request cookie name as key.
+func CookieKey(name string) KeyFunc {
+	return func(ctx *fasthttp.RequestCtx) []byte {
+		return ctx.Request.Header.Cookie(name)
+	}
+}
+
+// QueryArgKey returns a KeyFunc which takes the value of query argument name as key.
+func QueryArgKey(name string) KeyFunc {
+	return func(ctx *fasthttp.RequestCtx) []byte {
+		return ctx.QueryArgs().Peek(name)
+	}
+}
+
+// ClientIPKey is a KeyFunc which takes the IP of client as key.
+func ClientIPKey(ctx *fasthttp.RequestCtx) []byte {
+	ip := ctx.RemoteIP()
+	if len(ip) == 0 || ip.IsUnspecified() {
+		return nil
+	}
+
+	return []byte(ip.String())
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Mirror configures mirroring requests to a shadow upstream, it's used to test
+// a new version of upstream with real traffic. The requests are copied and sent
+// in background, the response of shadow upstream is discarded, so mirroring
+// never affects the response or latency of clients.
+type Mirror struct {
+	// Addr of shadow upstream, it's host:port or URL like UpstreamConfig.Addr.
+	Addr string
+	// Percent in (0, 100] of requests to mirror, default is 100.
+	Percent float64
+	// Routes are the names of routes in Router to mirror, all requests are
+	// mirrored if it's empty.
+	Routes []string
+	// MaxBodySize is the max size of request body could be mirrored, default is 64KB.
+	MaxBodySize int
+	// MaxConcurrency is the max number of mirrored requests in flight, more
+	// requests are dropped, default is 100.
+	MaxConcurrency int
+	// Timeout of mirrored request, default is 5s.
+	Timeout time.Duration
+	// OnResult is called with the status and latency of each mirrored request,
+	// err is not nil if it failed.
+	OnResult func(statusCode int, latency time.Duration, err error)
+}
+
+// withDefaults fills the zero fields with default values.
+func (m Mirror) withDefaults() Mirror {
+	if m.Percent <= 0 || m.Percent > 100 {
+		m.Percent = 100
+	}
+	if m.MaxBodySize <= 0 {
+		m.MaxBodySize = 64 * 1024
+	}
+	if m.MaxConcurrency <= 0 {
+		m.MaxConcurrency = 100
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = 5 * time.Second
+	}
+
+	return m
+}
+
+// MirrorStats is the statistics of mirrored requests.
+type MirrorStats struct {
+	// Mirrored is the number of requests sent to shadow upstream.
+	Mirrored uint64
+	// Dropped is the number of requests not mirrored since MaxConcurrency is reached.
+	Dropped uint64
+	// Failed is the number of mirrored requests which failed or got 5xx.
+	Failed uint64
+	// Latency is the total latency of mirrored requests.
+	Latency time.Duration
+}
+
+// mirror keeps the shadow upstream and statistics of mirroring.
+type mirror struct {
+	Mirror
+
+	shadow *upstream
+	routes map[string]struct{}
+	// sem limits the mirrored requests in flight.
+	sem chan struct{}
+
+	mirrored atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+	latency  atomic.Int64
+}
+
+func newMirror(m Mirror) *mirror {
+	m = m.withDefaults()
+	mr := &mirror{
+		Mirror: m,
+		sem:    make(chan struct{}, m.MaxConcurrency),
+	}
+	if len(m.Routes) != 0 {
+		mr.routes = make(map[string]struct{}, len(m.Routes))
+		for _, route := range m.Routes {
+			mr.routes[route] = struct{}{}
+		}
+	}
+
+	return mr
+}
+
+// init creates the shadow upstream, it's called after all options are applied
+// so that the TLS options are used.
+func (m *mirror) init(opt *buildOption) error {
+	shadow, err := newUpstream(m.Addr, 1, opt)
+	if err != nil {
+		return err
+	}
+	// the response is discarded, no need to stream it.
+	shadow.StreamResponseBody = false
+	m.shadow = shadow
+
+	return nil
+}
+
+// allowRequest reports whether the request in ctx should be mirrored.
+func (m *mirror) allowRequest(ctx *fasthttp.RequestCtx) bool {
+	if m.routes != nil {
+		if _, ok := m.routes[RouteName(ctx)]; !ok {
+			return false
+		}
+	}
+
+	if m.Percent < 100 && rand.Float64()*100 >= m.Percent {
+		return false
+	}
+
+	return bufferableBody(&ctx.Request, m.MaxBodySize)
+}
+
+// stats returns the statistics of mirroring.
+func (m *mirror) stats() MirrorStats {
+	return MirrorStats{
+		Mirrored: m.mirrored.Load(),
+		Dropped:  m.dropped.Load(),
+		Failed:   m.failed.Load(),
+		Latency:  time.Duration(m.latency.Load()),
+	}
+}
+
+// mirrorRequest sends a copy of the request in ctx to the shadow upstream in
+// background, it returns immediately.
+func (p *ReverseProxy) mirrorRequest(ctx *fasthttp.RequestCtx) {
+	m := p.opt.mirror
+	if m == nil || !m.allowRequest(ctx) {
+		return
+	}
+
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		return
+	}
+
+	req := fasthttp.AcquireRequest()
+	ctx.Request.CopyTo(req)
+
+	opt := p.opt
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-m.sem }()
+		defer fasthttp.ReleaseRequest(req)
+
+		res := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(res)
+
+		shadow := m.shadow
+		if !opt.disableVirtualHost {
+			req.SetHost(shadow.Addr)
+		}
+		if shadow.IsTLS {
+			req.URI().SetScheme("https")
+		} else {
+			req.URI().SetScheme("http")
+		}
+		p.rewritePath(req, shadow.basePath)
+		if opt.director != nil {
+			opt.director(req, shadow.Addr)
+		}
+
+		start := time.Now()
+		err := shadow.DoTimeout(req, res, m.Timeout)
+		latency := time.Since(start)
+
+		m.mirrored.Add(1)
+		m.latency.Add(int64(latency))
+		if err != nil || res.StatusCode() >= fasthttp.StatusInternalServerError {
+			m.failed.Add(1)
+		}
+		debugF(opt.debug, opt.logger, "mirror request, addr = %s, status = %d, latency = %s, err = %v",
+			shadow.Addr, res.StatusCode(), latency, err)
+
+		if m.OnResult != nil {
+			m.OnResult(res.StatusCode(), latency, err)
+		}
+	}()
+}
+
+// MirrorStats returns the statistics of mirrored requests, it's zero if
+// mirroring is not enabled.
+func (p *ReverseProxy) MirrorStats() MirrorStats {
+	if p.opt.mirror == nil {
+		return MirrorStats{}
+	}
+
+	return p.opt.mirror.stats()
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_mirror_allowRequest(t *testing.T) {
+	m := newMirror(Mirror{Addr: "localhost:8080", Routes: []string{"api"}, MaxBodySize: 4})
+
+	ctx := newTestRequestCtx(fasthttp.MethodPost, "http://example.com/")
+	assert.False(t, m.allowRequest(ctx))
+
+	ctx.SetUserValue(_routeNameKey, "api")
+	assert.True(t, m.allowRequest(ctx))
+
+	ctx.Request.SetBodyString("too large")
+	assert.False(t, m.allowRequest(ctx))
+
+	ctx.SetUserValue(_routeNameKey, "web")
+	ctx.Request.SetBodyString("")
+	assert.False(t, m.allowRequest(ctx))
+}
+
+func Test_ReverseProxy_WithMirror(t *testing.T) {
+	type shadowed struct {
+		host, path, body string
+	}
+	shadowCh := make(chan shadowed, 10)
+	shadowAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(200 * time.Millisecond)
+		shadowCh <- shadowed{
+			host: string(ctx.Host()),
+			path: string(ctx.Path()),
+			body: string(ctx.Request.Body()),
+		}
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+	})
+	primaryAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("primary")
+	})
+
+	type result struct {
+		status  int
+		latency time.Duration
+		err     error
+	}
+	resultCh := make(chan result, 10)
+	proxy, err := NewReverseProxyWith(
+		WithAddress(primaryAddr),
+		WithMirror(Mirror{
+			Addr:           "http://" + shadowAddr + "/shadow",
+			Routes:         []string{"api"},
+			MaxConcurrency: 1,
+			OnResult: func(status int, latency time.Duration, err error) {
+				resultCh <- result{status: status, latency: latency, err: err}
+			},
+		}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	router := NewRouter()
+	assert.Nil(t, router.Handle("api", Rule{PathPrefix: "/api"}, proxy))
+	assert.Nil(t, router.Handle("web", Rule{PathPrefix: "/"}, proxy))
+
+	serve := func(method, uri, body string) {
+		ctx := newTestRequestCtx(method, uri)
+		ctx.Request.SetBodyString(body)
+		start := time.Now()
+		router.ServeHTTP(ctx)
+		// the shadow upstream never slows down the client.
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+		assert.Equal(t, "primary", string(ctx.Response.Body()))
+	}
+
+	serve(fasthttp.MethodPost, "http://example.com/api/users", "mirrored")
+	// dropped since a mirrored request is in flight.
+	serve(fasthttp.MethodPost, "http://example.com/api/users", "dropped")
+	// not in the routes to mirror.
+	serve(fasthttp.MethodGet, "http://example.com/index.html", "")
+
+	select {
+	case s := <-shadowCh:
+		assert.Equal(t, shadowed{host: shadowAddr, path: "/shadow/api/users", body: "mirrored"}, s)
+	case <-time.After(time.Second):
+		t.Fatal("request is not mirrored")
+	}
+
+	r := <-resultCh
+	assert.Nil(t, r.err)
+	assert.Equal(t, fasthttp.StatusCreated, r.status)
+	assert.GreaterOrEqual(t, r.latency, 200*time.Millisecond)
+
+	stats := proxy.MirrorStats()
+	assert.Equal(t, uint64(1), stats.Mirrored)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, uint64(0), stats.Failed)
+	assert.Equal(t, r.latency, stats.Latency)
+}
+
+func Test_WithMirror_Error(t *testing.T) {
+	proxy, err := NewReverseProxyWith(WithAddress("localhost:8080"), WithMirror(Mirror{Addr: "ftp://localhost:21"}))
+	assert.Nil(t, proxy)
+	assert.NotNil(t, err)
+}
+
+func Test_WithMirror_reused(t *testing.T) {
+	option := WithMirror(Mirror{Addr: "localhost:9090"})
+	proxy1, err := NewReverseProxyWith(WithAddress("localhost:8080"), option)
+	assert.Nil(t, err)
+	defer proxy1.Close()
+	proxy2, err := NewReverseProxyWith(WithAddress("localhost:8081"), option)
+	assert.Nil(t, err)
+	defer proxy2.Close()
+
+	// the shadow upstream, semaphore and stats are not shared by the proxies
+	// built with the same Option.
+	m1, m2 := proxy1.opt.mirror, proxy2.opt.mirror
+	assert.NotSame(t, m1, m2)
+	assert.NotSame(t, m1.shadow, m2.shadow)
+	assert.NotEqual(t, m1.sem, m2.sem)
+
+	m1.dropped.Add(1)
+	assert.Equal(t, uint64(1), proxy1.MirrorStats().Dropped)
+	assert.Equal(t, uint64(0), proxy2.MirrorStats().Dropped)
+}
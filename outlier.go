@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// OutlierDetection configures passive outlier detection, which is similar to
+// Envoy's outlier detection. The results of requests proxied to each upstream
+// are tracked, and the upstream will be ejected from balancer for a while if
+// it fails consecutively. The ejection time grows exponentially each time the
+// upstream is ejected again.
+// ref to: https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/outlier
+type OutlierDetection struct {
+	// ConsecutiveErrors is the number of consecutive connection errors or
+	// timeouts to eject an upstream, default is 5.
+	ConsecutiveErrors int
+	// Consecutive5xx is the number of consecutive 5xx responses (connection
+	// errors and timeouts are counted too) to eject an upstream, default is 5.
+	Consecutive5xx int
+	// BaseEjectionTime is the ejection time of first ejection, default is 30s.
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime caps the ejection time, default is 300s.
+	MaxEjectionTime time.Duration
+	// MaxEjectionPercent is the max percentage of upstreams could be ejected
+	// at the same time, default is 10. At least one upstream could be ejected
+	// regardless of this value.
+	MaxEjectionPercent int
+}
+
+// withDefaults fills the zero fields with default values.
+func (od OutlierDetection) withDefaults() OutlierDetection {
+	if od.ConsecutiveErrors <= 0 {
+		od.ConsecutiveErrors = 5
+	}
+	if od.Consecutive5xx <= 0 {
+		od.Consecutive5xx = 5
+	}
+	if od.BaseEjectionTime <= 0 {
+		od.BaseEjectionTime = 30 * time.Second
+	}
+	if od.MaxEjectionTime <= 0 {
+		od.MaxEjectionTime = 300 * time.Second
+	}
+	if od.MaxEjectionTime < od.BaseEjectionTime {
+		od.MaxEjectionTime = od.BaseEjectionTime
+	}
+	if od.MaxEjectionPercent <= 0 {
+		od.MaxEjectionPercent = 10
+	}
+
+	return od
+}
+
+// ejectionTime calculates the ejection time of the nth ejection.
+func (od OutlierDetection) ejectionTime(n int) time.Duration {
+	d := od.BaseEjectionTime
+	for i := 1; i < n && d < od.MaxEjectionTime; i++ {
+		d *= 2
+	}
+
+	if d > od.MaxEjectionTime {
+		d = od.MaxEjectionTime
+	}
+
+	return d
+}
+
+// outlierState keeps the states of passive outlier detection of an upstream.
+type outlierState struct {
+	mutex sync.Mutex
+
+	consecutiveErrors int
+	consecutive5xx    int
+
+	// ejections is the number of times the upstream has been ejected.
+	ejections int
+	// returnedAt is the time when the upstream came back from last ejection.
+	returnedAt time.Time
+}
+
+// observe records the result of a request, and returns true if the upstream
+// should be ejected.
+func (s *outlierState) observe(od *OutlierDetection, statusCode int, err error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case err != nil:
+		kind := classifyError(err)
+		if kind == ErrorKindNoUpstream || kind == ErrorKindResponse {
+			// not the fault of upstream.
+			return false
+		}
+		s.consecutiveErrors++
+		s.consecutive5xx++
+	case statusCode >= 500:
+		s.consecutiveErrors = 0
+		s.consecutive5xx++
+	default:
+		s.consecutiveErrors = 0
+		s.consecutive5xx = 0
+		return false
+	}
+
+	if s.consecutiveErrors < od.ConsecutiveErrors && s.consecutive5xx < od.Consecutive5xx {
+		return false
+	}
+
+	s.consecutiveErrors = 0
+	s.consecutive5xx = 0
+	return true
+}
+
+// observeOutlier records the result of a request proxied to u, and ejects u
+// from balancer if it fails consecutively.
+func (p *ReverseProxy) observeOutlier(u *upstream, statusCode int, err error) {
+	od := p.opt.outlierDetection
+	if od == nil || !u.outlier.observe(od, statusCode, err) {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.upstreams == nil || u.ejected.Load() {
+		return
+	}
+
+	ejected := 0
+	for _, up := range p.upstreams {
+		if up.ejected.Load() {
+			ejected++
+		}
+	}
+	if ejected > 0 && (ejected+1)*100 > od.MaxEjectionPercent*len(p.upstreams) {
+		debugF(p.opt.debug, p.opt.logger, "outlier detection: could not eject %s, max ejection percent reached", u.Addr)
+		return
+	}
+
+	now := time.Now()
+	u.outlier.mutex.Lock()
+	// forgive the upstream if it has been working well for a long time.
+	if !u.outlier.returnedAt.IsZero() && now.Sub(u.outlier.returnedAt) > od.MaxEjectionTime {
+		u.outlier.ejections = 0
+	}
+	u.outlier.ejections++
+	d := od.ejectionTime(u.outlier.ejections)
+	u.outlier.mutex.Unlock()
+
+	u.ejected.Store(true)
+	p.rebuild()
+	errorF(p.opt.logger, "outlier detection: upstream %s is ejected for %s", u.Addr, d)
+
+	time.AfterFunc(d, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		u.outlier.mutex.Lock()
+		u.outlier.returnedAt = time.Now()
+		u.outlier.mutex.Unlock()
+
+		u.ejected.Store(false)
+		if p.upstreams == nil {
+			// closed
+			return
+		}
+		p.rebuild()
+		debugF(p.opt.debug, p.opt.logger, "outlier detection: upstream %s is back", u.Addr)
+	})
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_OutlierDetection_ejectionTime(t *testing.T) {
+	od := OutlierDetection{
+		BaseEjectionTime: time.Second,
+		MaxEjectionTime:  5 * time.Second,
+	}.withDefaults()
+
+	assert.Equal(t, time.Second, od.ejectionTime(1))
+	assert.Equal(t, 2*time.Second, od.ejectionTime(2))
+	assert.Equal(t, 4*time.Second, od.ejectionTime(3))
+	assert.Equal(t, 5*time.Second, od.ejectionTime(4))
+	assert.Equal(t, 5*time.Second, od.ejectionTime(100))
+}
+
+func Test_outlierState_observe(t *testing.T) {
+	od := OutlierDetection{ConsecutiveErrors: 2, Consecutive5xx: 3}.withDefaults()
+	s := &outlierState{}
+
+	// 5xx responses
+	assert.False(t, s.observe(&od, fasthttp.StatusInternalServerError, nil))
+	assert.False(t, s.observe(&od, fasthttp.StatusBadGateway, nil))
+	assert.True(t, s.observe(&od, fasthttp.StatusServiceUnavailable, nil))
+
+	// success resets counters
+	assert.False(t, s.observe(&od, fasthttp.StatusInternalServerError, nil))
+	assert.False(t, s.observe(&od, fasthttp.StatusOK, nil))
+	assert.False(t, s.observe(&od, fasthttp.StatusInternalServerError, nil))
+
+	// connection errors
+	s = &outlierState{}
+	assert.False(t, s.observe(&od, 0, fasthttp.ErrConnectionClosed))
+	assert.True(t, s.observe(&od, 0, fasthttp.ErrTimeout))
+
+	// not the fault of upstream
+	s = &outlierState{}
+	assert.False(t, s.observe(&od, 0, ErrNoUpstream))
+	assert.False(t, s.observe(&od, 0, ErrNoUpstream))
+}
+
+func Test_ReverseProxy_WithOutlierDetection(t *testing.T) {
+	goodAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("good")
+	})
+	badAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("bad")
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{goodAddr: 1, badAddr: 1}),
+		WithOutlierDetection(OutlierDetection{
+			Consecutive5xx:     2,
+			BaseEjectionTime:   100 * time.Millisecond,
+			MaxEjectionPercent: 50,
+		}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	serve := func() string {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		return string(ctx.Response.Body())
+	}
+
+	bad := 0
+	for i := 0; i < 10; i++ {
+		if serve() == "bad" {
+			bad++
+		}
+	}
+	assert.Equal(t, 2, bad, "bad upstream should be ejected after 2 consecutive 5xx")
+
+	// bad upstream comes back after ejection time.
+	time.Sleep(150 * time.Millisecond)
+	proxy.mutex.RLock()
+	defer proxy.mutex.RUnlock()
+	assert.Len(t, proxy.available, 2)
+}
+
+func Test_ReverseProxy_WithOutlierDetection_maxEjectionPercent(t *testing.T) {
+	addrs := make(map[string]Weight)
+	for i := 0; i < 3; i++ {
+		addrs[newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		})] = 1
+	}
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(addrs),
+		WithOutlierDetection(OutlierDetection{Consecutive5xx: 1, MaxEjectionPercent: 50}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	for i := 0; i < 10; i++ {
+		proxy.ServeHTTP(newTestRequestCtx(fasthttp.MethodGet, "http://example.com/"))
+	}
+
+	// only one of three upstreams could be ejected with 50 percent.
+	proxy.mutex.RLock()
+	defer proxy.mutex.RUnlock()
+	assert.Len(t, proxy.available, 2)
+}
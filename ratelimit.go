@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RateLimitResult is the result of taking a token from the bucket.
+type RateLimitResult struct {
+	// Allowed is true if a token is taken.
+	Allowed bool
+	// Remaining is the number of tokens left in the bucket.
+	Remaining int
+	// RetryAfter is the time to wait until a token is available, it's 0 if allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full.
+	Reset time.Duration
+}
+
+// RateLimitStore keeps the token buckets of keys, it could be implemented by a
+// shared store so that multiple proxies share the limit.
+type RateLimitStore interface {
+	// Take takes a token from the bucket of key, the bucket holds burst tokens
+	// at most and is refilled by rate tokens per second. A new bucket is full.
+	Take(key string, rate float64, burst int, now time.Time) (RateLimitResult, error)
+}
+
+// tokenBucket is the state of a bucket in MemoryRateLimitStore.
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// MemoryRateLimitStore keeps the token buckets in memory, the least recently
+// used buckets are evicted if there are too many keys, and they're full when
+// the keys come back.
+type MemoryRateLimitStore struct {
+	maxKeys int
+
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+// NewMemoryRateLimitStore creates a MemoryRateLimitStore keeping maxKeys buckets
+// at most, default is 10000 if maxKeys <= 0.
+func NewMemoryRateLimitStore(maxKeys int) *MemoryRateLimitStore {
+	if maxKeys <= 0 {
+		maxKeys = 10000
+	}
+
+	return &MemoryRateLimitStore{
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element, maxKeys),
+		lru:     list.New(),
+	}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int, now time.Time) (RateLimitResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var b *tokenBucket
+	if elem, ok := s.buckets[key]; ok {
+		s.lru.MoveToFront(elem)
+		b = elem.Value.(*tokenBucket)
+		if elapsed := now.Sub(b.last); elapsed > 0 {
+			b.tokens = math.Min(float64(burst), b.tokens+elapsed.Seconds()*rate)
+		}
+	} else {
+		if s.lru.Len() >= s.maxKeys {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		b = &tokenBucket{key: key, tokens: float64(burst)}
+		s.buckets[key] = s.lru.PushFront(b)
+	}
+	b.last = now
+
+	result := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsDuration((float64(burst) - b.tokens) / rate)
+
+	return result, nil
+}
+
+// Len returns the number of buckets kept.
+func (s *MemoryRateLimitStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lru.Len()
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// RateLimit configures limiting the rate of requests of each client by token
+// bucket, the client is identified by Key.
+type RateLimit struct {
+	// Rate is the number of tokens refilled per second, it's the sustained
+	// rate of requests allowed.
+	Rate float64
+	// Burst is the max number of requests allowed at once, default is the
+	// ceiling of Rate.
+	Burst int
+	// Key identifies the client, such as HeaderKey("X-API-Key"), default is
+	// ClientIPKey. The requests without key share the same bucket.
+	Key KeyFunc
+	// Store keeps the token buckets, default is a MemoryRateLimitStore
+	// keeping 10000 keys.
+	Store RateLimitStore
+	// OnError is called when the store fails, the request is allowed.
+	OnError func(err error)
+}
+
+// withDefaults fills the zero fields with default values.
+func (rl RateLimit) withDefaults() RateLimit {
+	if rl.Rate <= 0 {
+		rl.Rate = 1
+	}
+	if rl.Burst <= 0 {
+		rl.Burst = int(math.Ceil(rl.Rate))
+	}
+	if rl.Key == nil {
+		rl.Key = ClientIPKey
+	}
+	if rl.Store == nil {
+		rl.Store = NewMemoryRateLimitStore(0)
+	}
+
+	return rl
+}
+
+// RateLimiter is a middleware limiting the rate of requests to the next
+// handler such as ReverseProxy. The requests over limit are rejected with 429
+// and Retry-After header, and RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers are set on all responses.
+type RateLimiter struct {
+	RateLimit
+
+	next Handler
+}
+
+// NewRateLimiter creates a RateLimiter serving the allowed requests with next.
+func NewRateLimiter(next Handler, rl RateLimit) *RateLimiter {
+	return &RateLimiter{
+		RateLimit: rl.withDefaults(),
+		next:      next,
+	}
+}
+
+// ServeHTTP serves the request with next handler if it's allowed.
+func (l *RateLimiter) ServeHTTP(ctx *fasthttp.RequestCtx) {
+	result, err := l.Store.Take(string(l.Key(ctx)), l.Rate, l.Burst, time.Now())
+	if err != nil {
+		if l.OnError != nil {
+			l.OnError(err)
+		}
+		l.next.ServeHTTP(ctx)
+		return
+	}
+
+	if !result.Allowed {
+		ctx.Response.Reset()
+		ctx.Response.SetStatusCode(fasthttp.StatusTooManyRequests)
+		ctx.Response.SetBodyString(http.StatusText(fasthttp.StatusTooManyRequests))
+		ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, ceilSeconds(result.RetryAfter))
+		l.setHeaders(&ctx.Response.Header, result)
+		return
+	}
+
+	l.next.ServeHTTP(ctx)
+	// the headers of response are replaced by upstream, set them after serving.
+	l.setHeaders(&ctx.Response.Header, result)
+}
+
+// setHeaders sets the RateLimit-* headers of response.
+func (l *RateLimiter) setHeaders(h *fasthttp.ResponseHeader, result RateLimitResult) {
+	h.Set("RateLimit-Limit", strconv.Itoa(l.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", ceilSeconds(result.Reset))
+}
+
+// ceilSeconds formats d in seconds rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_MemoryRateLimitStore_Take(t *testing.T) {
+	s := NewMemoryRateLimitStore(10)
+	now := time.Now()
+
+	// burst is allowed at once.
+	for i := 2; i >= 0; i-- {
+		result, err := s.Take("client", 2, 3, now)
+		assert.Nil(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, i, result.Remaining)
+	}
+
+	result, _ := s.Take("client", 2, 3, now)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, result.Reset)
+
+	// refilled by rate.
+	result, _ = s.Take("client", 2, 3, now.Add(500*time.Millisecond))
+	assert.True(t, result.Allowed)
+	result, _ = s.Take("client", 2, 3, now.Add(500*time.Millisecond))
+	assert.False(t, result.Allowed)
+
+	// refilled up to burst.
+	result, _ = s.Take("client", 2, 3, now.Add(time.Hour))
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+
+	// other keys have their own buckets.
+	result, _ = s.Take("other", 2, 3, now)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+}
+
+func Test_MemoryRateLimitStore_evict(t *testing.T) {
+	s := NewMemoryRateLimitStore(2)
+	now := time.Now()
+
+	_, _ = s.Take("a", 1, 1, now)
+	_, _ = s.Take("b", 1, 1, now)
+	// a is used recently, b is evicted.
+	result, _ := s.Take("a", 1, 1, now)
+	assert.False(t, result.Allowed)
+	_, _ = s.Take("c", 1, 1, now)
+	assert.Equal(t, 2, s.Len())
+
+	result, _ = s.Take("a", 1, 1, now)
+	assert.False(t, result.Allowed)
+	// the bucket of evicted key is full.
+	result, _ = s.Take("b", 1, 1, now)
+	assert.True(t, result.Allowed)
+}
+
+// failingStore is a RateLimitStore which always fails.
+type failingStore struct{}
+
+func (failingStore) Take(string, float64, int, time.Time) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("store is down")
+}
+
+func Test_RateLimiter(t *testing.T) {
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	proxy, err := NewReverseProxyWith(WithAddress(addr))
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	limiter := NewRateLimiter(proxy, RateLimit{Rate: 0.5, Burst: 2, Key: HeaderKey("X-API-Key")})
+
+	serve := func(key string) *fasthttp.RequestCtx {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		ctx.Request.Header.Set("X-API-Key", key)
+		limiter.ServeHTTP(ctx)
+		return ctx
+	}
+
+	ctx := serve("alice")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "ok", string(ctx.Response.Body()))
+	assert.Equal(t, "2", string(ctx.Response.Header.Peek("RateLimit-Limit")))
+	assert.Equal(t, "1", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+	assert.Equal(t, "2", string(ctx.Response.Header.Peek("RateLimit-Reset")))
+
+	ctx = serve("alice")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "0", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+
+	ctx = serve("alice")
+	assert.Equal(t, fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(t, "Too Many Requests", string(ctx.Response.Body()))
+	assert.Equal(t, "2", string(ctx.Response.Header.Peek(fasthttp.HeaderRetryAfter)))
+	assert.Equal(t, "0", string(ctx.Response.Header.Peek("RateLimit-Remaining")))
+	assert.Equal(t, "4", string(ctx.Response.Header.Peek("RateLimit-Reset")))
+
+	// another client is not limited.
+	ctx = serve("bob")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	// the request is allowed if the store fails.
+	var storeErr error
+	limiter = NewRateLimiter(proxy, RateLimit{Rate: 1, Store: failingStore{}, OnError: func(err error) { storeErr = err }})
+	ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	limiter.ServeHTTP(ctx)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.NotNil(t, storeErr)
+}
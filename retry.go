@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RetryPolicy configures retrying the failed request on another upstream
+// chosen by balancer. The request body is buffered to be replayed, so
+// requests with body larger than MaxBodySize would not be retried.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of attempts including the first one, default is 2.
+	MaxAttempts int
+	// RetryOn is the kinds of error to retry, default is ErrorKindDial and ErrorKindConnReset.
+	RetryOn []ErrorKind
+	// RetryOnStatus is the status codes of upstream response to retry, such as 502, 503.
+	RetryOnStatus []int
+	// IdempotentOnly denotes only retry the requests with idempotent methods,
+	// or with Idempotency-Key header.
+	IdempotentOnly bool
+	// PerTryTimeout is the timeout of each attempt, the timeout specified by
+	// WithTimeout is used if it's 0.
+	PerTryTimeout time.Duration
+	// Backoff is the base interval to wait before retrying, it's doubled for
+	// each retry. Retry immediately if it's 0.
+	Backoff time.Duration
+	// MaxBackoff caps the interval of backoff, default is 1s.
+	MaxBackoff time.Duration
+	// MaxBodySize is the max size of request body could be buffered to replay, default is 64KB.
+	MaxBodySize int
+}
+
+// withDefaults fills the zero fields with default values.
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxAttempts <= 0 {
+		rp.MaxAttempts = 2
+	}
+	if len(rp.RetryOn) == 0 {
+		rp.RetryOn = []ErrorKind{ErrorKindDial, ErrorKindConnReset}
+	}
+	if rp.MaxBackoff <= 0 {
+		rp.MaxBackoff = time.Second
+	}
+	if rp.MaxBodySize <= 0 {
+		rp.MaxBodySize = 64 * 1024
+	}
+
+	return rp
+}
+
+// allowRequest reports whether the request could be retried.
+func (rp *RetryPolicy) allowRequest(req *fasthttp.Request) bool {
+	if rp.MaxAttempts <= 1 {
+		return false
+	}
+
+	if rp.IdempotentOnly && !isIdempotent(req) {
+		return false
+	}
+
+	return bufferableBody(req, rp.MaxBodySize)
+}
+
+// bufferableBody reports whether the body of req is at most maxSize bytes, so
+// that it could be replayed. It buffers the body if the body is a stream.
+func bufferableBody(req *fasthttp.Request, maxSize int) bool {
+	if req.IsBodyStream() {
+		// chunked (-1) or too large body could not be buffered.
+		if n := req.Header.ContentLength(); n < 0 || n > maxSize {
+			return false
+		}
+	}
+
+	return len(req.Body()) <= maxSize
+}
+
+// retryable reports whether the result of attempt should be retried.
+func (rp *RetryPolicy) retryable(attempt, statusCode int, err error) bool {
+	if attempt >= rp.MaxAttempts {
+		return false
+	}
+
+	if err != nil {
+		kind := classifyError(err)
+		for _, k := range rp.RetryOn {
+			if k == kind {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, code := range rp.RetryOnStatus {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wait sleeps for the backoff interval of attempt.
+func (rp *RetryPolicy) wait(attempt int) {
+	if rp.Backoff <= 0 {
+		return
+	}
+
+	d := rp.Backoff
+	for i := 1; i < attempt && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+
+	time.Sleep(d)
+}
+
+// isIdempotent reports whether the request is idempotent.
+// ref to: https://golang.org/src/net/http/request.go isReplayable
+func isIdempotent(req *fasthttp.Request) bool {
+	switch string(req.Header.Method()) {
+	case fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodOptions,
+		fasthttp.MethodTrace, fasthttp.MethodPut, fasthttp.MethodDelete:
+		return true
+	}
+
+	return len(req.Header.Peek("Idempotency-Key")) != 0 ||
+		len(req.Header.Peek("X-Idempotency-Key")) != 0
+}
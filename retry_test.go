@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_RetryPolicy_retryable(t *testing.T) {
+	rp := RetryPolicy{MaxAttempts: 3, RetryOnStatus: []int{fasthttp.StatusServiceUnavailable}}.withDefaults()
+
+	assert.True(t, rp.retryable(1, 0, fasthttp.ErrConnectionClosed))
+	assert.True(t, rp.retryable(2, fasthttp.StatusServiceUnavailable, nil))
+	assert.False(t, rp.retryable(3, fasthttp.StatusServiceUnavailable, nil), "max attempts reached")
+	assert.False(t, rp.retryable(1, 0, fasthttp.ErrTimeout), "timeout is not retried by default")
+	assert.False(t, rp.retryable(1, fasthttp.StatusInternalServerError, nil))
+	assert.False(t, rp.retryable(1, fasthttp.StatusOK, nil))
+}
+
+func Test_RetryPolicy_allowRequest(t *testing.T) {
+	rp := RetryPolicy{IdempotentOnly: true, MaxBodySize: 8}.withDefaults()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	assert.True(t, rp.allowRequest(req))
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	assert.False(t, rp.allowRequest(req))
+	req.Header.Set("Idempotency-Key", "abc")
+	assert.True(t, rp.allowRequest(req))
+
+	req.SetBodyString("larger than 8 bytes")
+	assert.False(t, rp.allowRequest(req))
+
+	req.SetBodyStream(bytes.NewBufferString("chunked"), -1)
+	assert.False(t, rp.allowRequest(req))
+
+	req.SetBodyStream(bytes.NewBufferString("1234"), 4)
+	assert.True(t, rp.allowRequest(req))
+	assert.Equal(t, "1234", string(req.Body()))
+}
+
+func Test_ReverseProxy_WithRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	goodAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBody(ctx.Request.Body())
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{closedAddr: 1, goodAddr: 1}),
+		WithRetry(RetryPolicy{Backoff: time.Millisecond}),
+	)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodPost, "http://example.com/")
+		ctx.Request.SetBodyString("replayed")
+		proxy.ServeHTTP(ctx)
+
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+		assert.Equal(t, "replayed", string(ctx.Response.Body()))
+	}
+}
+
+func Test_ReverseProxy_WithRetry_status(t *testing.T) {
+	unavailableAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	})
+	goodAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("good")
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{unavailableAddr: 1, goodAddr: 1}),
+		WithRetry(RetryPolicy{
+			RetryOnStatus:  []int{fasthttp.StatusServiceUnavailable},
+			IdempotentOnly: true,
+		}),
+	)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		assert.Equal(t, "good", string(ctx.Response.Body()))
+	}
+
+	// non-idempotent requests are not retried.
+	unavailable := 0
+	for i := 0; i < 10; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodPost, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		if ctx.Response.StatusCode() == fasthttp.StatusServiceUnavailable {
+			unavailable++
+		}
+	}
+	assert.NotZero(t, unavailable)
+}
+
+func Test_ReverseProxy_WithRetry_allFailed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	proxy, err := NewReverseProxyWith(
+		WithAddress(closedAddr),
+		WithRetry(RetryPolicy{MaxAttempts: 3}),
+	)
+	assert.Nil(t, err)
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	proxy.ServeHTTP(ctx)
+	assert.Equal(t, fasthttp.StatusBadGateway, ctx.Response.StatusCode())
+}
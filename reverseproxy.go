@@ -6,8 +6,8 @@ package proxy
 
 import (
 	"errors"
-	"net"
-	"net/http"
+	"sync"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
@@ -18,14 +18,26 @@ const (
 
 // ReverseProxy reverse handler using fasthttp.HostClient
 type ReverseProxy struct {
-	// bla keeps balancer instance
+	// mutex protects bla, upstreams and available, since they would be
+	// changed when an upstream becomes unavailable or available again.
+	mutex sync.RWMutex
+
+	// bla keeps balancer instance, it distributes requests to available.
 	bla IBalancer
 
-	// clients
-	clients []*fasthttp.HostClient
+	// upstreams contains all upstream servers.
+	upstreams []*upstream
+
+	// available contains upstream servers those could be chosen.
+	available []*upstream
 
 	// opt contains finally option to open reverseProxy
 	opt *buildOption
+
+	// done is closed when ReverseProxy is closed to stop background goroutines.
+	done chan struct{}
+	// wg waits for background goroutines to quit.
+	wg sync.WaitGroup
 }
 
 // NewReverseProxyWith create an ReverseProxy with options
@@ -34,11 +46,21 @@ func NewReverseProxyWith(options ...Option) (*ReverseProxy, error) {
 	for _, opt := range options {
 		opt.apply(option)
 	}
+	if option.err != nil {
+		return nil, option.err
+	}
+	option.buildTLSConfig()
+	if option.mirror != nil {
+		if err := option.mirror.init(option); err != nil {
+			return nil, err
+		}
+	}
 
 	proxy := &ReverseProxy{
-		bla:     nil,
-		opt:     option,
-		clients: make([]*fasthttp.HostClient, 0, 2),
+		bla:       nil,
+		opt:       option,
+		upstreams: make([]*upstream, 0, 2),
+		done:      make(chan struct{}),
 	}
 
 	if err := proxy.init(); err != nil {
@@ -52,61 +74,160 @@ func NewReverseProxyWith(options ...Option) (*ReverseProxy, error) {
 // if opted.OpenBalance is true then create a balancer to ReverseProxy
 // else just create a HostClient to ReverseProxy and use it.
 func (p *ReverseProxy) init() error {
-	if len(p.opt.addresses) == 0 {
+	if len(p.opt.addresses) == 0 && p.opt.discoverer == nil {
 		return errors.New("no upstream server address")
 	}
 
-	if p.opt.openBalance {
+	if p.opt.openBalance || len(p.opt.addresses) == 0 {
 		// config balancer
-		p.clients = make([]*fasthttp.HostClient, 0, len(p.opt.addresses))
-		p.bla = NewBalancer(p.opt.weights)
-
-		for _, addr := range p.opt.addresses {
-			client := &fasthttp.HostClient{
-				Addr:                   addr,
-				Name:                   _fasthttpHostClientName,
-				IsTLS:                  p.opt.tlsConfig != nil,
-				TLSConfig:              p.opt.tlsConfig,
-				DisablePathNormalizing: p.opt.disablePathNormalizing,
-				MaxResponseBodySize:    p.opt.maxResponseBodySize,
-				StreamResponseBody:     p.opt.streamResponseBody,
+		p.upstreams = make([]*upstream, 0, len(p.opt.addresses))
+		for idx, addr := range p.opt.addresses {
+			u, err := newUpstream(addr, p.opt.weights[idx].Weight(), p.opt)
+			if err != nil {
+				return err
 			}
-			p.clients = append(p.clients, client)
+			p.upstreams = append(p.upstreams, u)
+		}
+	} else {
+		// not open balancer
+		u, err := newUpstream(p.opt.addresses[0], 1, p.opt)
+		if err != nil {
+			return err
 		}
+		p.upstreams = append(p.upstreams, u)
+	}
+	p.rebuild()
 
-		return nil
+	if p.opt.healthCheck != nil {
+		p.wg.Add(1)
+		go p.runHealthCheck(p.opt.healthCheck)
+	}
+
+	if p.opt.discoverer != nil {
+		p.wg.Add(1)
+		go p.watchDiscoverer(p.opt.discoverer)
 	}
 
-	// not open balancer
-	p.bla = nil
-	addr := p.opt.addresses[0]
-	client := &fasthttp.HostClient{
-		Addr:                   addr,
-		Name:                   _fasthttpHostClientName,
-		IsTLS:                  p.opt.tlsConfig != nil,
-		TLSConfig:              p.opt.tlsConfig,
-		DisablePathNormalizing: p.opt.disablePathNormalizing,
-		MaxResponseBodySize:    p.opt.maxResponseBodySize,
-		StreamResponseBody:     p.opt.streamResponseBody,
-		MaxConnDuration:        p.opt.maxConnDuration,
-	}
-	p.clients = append(p.clients, client)
 	return nil
 }
 
-func (p *ReverseProxy) getClient() *fasthttp.HostClient {
-	if p.clients == nil {
+// rebuild collects available upstreams and rebuilds the balancer with them.
+// p.mutex must be held by caller.
+func (p *ReverseProxy) rebuild() {
+	available := make([]*upstream, 0, len(p.upstreams))
+	weights := make([]W, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !u.available() {
+			continue
+		}
+		available = append(available, u)
+		weights = append(weights, u)
+	}
+
+	p.available = available
+	if len(weights) <= 1 {
+		// no need to balance.
+		p.bla = nil
+		return
+	}
+
+	if ub, ok := p.bla.(IUpdatableBalancer); ok {
+		ub.Update(weights)
+		return
+	}
+	p.bla = p.opt.balancerFactory(weights)
+}
+
+// getClient chooses an available upstream to send request to, upstreams in
+// excluded would be skipped. nil means there is no upstream available.
+// The result of request is not reported to balancer.
+func (p *ReverseProxy) getClient(excluded ...*upstream) *upstream {
+	u, _ := p.distribute(nil, excluded)
+	return u
+}
+
+// distribute chooses an available upstream to send request ctx to, upstreams in
+// excluded would be skipped. nil means there is no upstream available.
+// The in-flight requests of chosen upstream is increased, and it's decreased by do.
+func (p *ReverseProxy) distribute(ctx *fasthttp.RequestCtx, excluded []*upstream) (*upstream, distribution) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.upstreams == nil {
 		// closed
 		panic("ReverseProxy has been closed")
 	}
 
+	n := len(p.available)
+	if n == 0 {
+		return nil, distribution{}
+	}
+
+	// the upstream of affinity cookie takes precedence over balancer.
+	if u := p.stickyUpstream(ctx); u != nil && !containsUpstream(excluded, u) {
+		u.inflight.Add(1)
+		return u, distribution{}
+	}
+
+	idx := 0
+	dist := distribution{}
 	if p.bla != nil {
 		// bla has been opened
-		idx := p.bla.Distribute()
-		return p.clients[idx]
+		if rb, ok := p.bla.(IRequestBalancer); ok && ctx != nil {
+			idx = rb.DistributeRequest(ctx)
+		} else {
+			idx = p.bla.Distribute()
+		}
+		if fb, ok := p.bla.(IFeedbackBalancer); ok {
+			dist = distribution{bla: fb, idx: idx}
+		}
+	}
+
+	// take the next one if the chosen upstream is excluded.
+	for i := 0; i < n; i++ {
+		u := p.available[(idx+i)%n]
+		if containsUpstream(excluded, u) {
+			continue
+		}
+
+		if i != 0 {
+			// the upstream is not chosen by balancer, tell balancer
+			// the chosen one is not used.
+			dist.done(0, nil)
+			dist = distribution{}
+		}
+
+		// count in-flight here with p.mutex held, so that draining
+		// would never miss the request.
+		u.inflight.Add(1)
+		return u, dist
+	}
+
+	dist.done(0, nil)
+	return nil, distribution{}
+}
+
+// distribution records the balancer and index which an upstream is chosen by,
+// it's used to report the result of request to IFeedbackBalancer.
+type distribution struct {
+	bla IFeedbackBalancer
+	idx int
+}
+
+func (d distribution) done(elapsed time.Duration, err error) {
+	if d.bla != nil {
+		d.bla.Done(d.idx, elapsed, err)
 	}
+}
 
-	return p.clients[0]
+func containsUpstream(upstreams []*upstream, u *upstream) bool {
+	for _, up := range upstreams {
+		if up == u {
+			return true
+		}
+	}
+
+	return false
 }
 
 // ServeHTTP ReverseProxy to serve
@@ -116,9 +237,7 @@ func (p *ReverseProxy) ServeHTTP(ctx *fasthttp.RequestCtx) {
 	res := &ctx.Response
 
 	// prepare request(replace headers and some URL host)
-	if ip, _, err := net.SplitHostPort(ctx.RemoteAddr().String()); err == nil {
-		req.Header.Add("X-Forwarded-For", ip)
-	}
+	p.opt.forwardedHeaders.apply(ctx)
 
 	// to save all response header
 	// resHeaders := make(map[string]string)
@@ -131,71 +250,235 @@ func (p *ReverseProxy) ServeHTTP(ctx *fasthttp.RequestCtx) {
 	// 	resHeaders[key] = value
 	// })
 
-	for _, h := range hopHeaders {
-		// if h == "Te" && hv == "trailers" {
-		// 	continue
-		// }
-		req.Header.Del(h)
+	// tell upstream that trailers are supported if the client does.
+	keepTrailers := containsToken(req.Header.PeekAll(fasthttp.HeaderTE), "trailers")
+	removeHopHeaders(&req.Header)
+	if keepTrailers {
+		req.Header.Set(fasthttp.HeaderTE, "trailers")
 	}
+	addVia(&req.Header, req.Header.IsHTTP11(), p.opt.via)
 
-	c := p.getClient()
-	debugF(p.opt.debug, p.opt.logger, "rev request headers to proxy, addr = %s, headers = %s", c.Addr, req.Header.String())
+	// mirror the request before it's modified for upstream.
+	p.mirrorRequest(ctx)
 
-	// assign the host to support virtual hosting, aka shared web hosting (one IP, multiple domains)
-	if !p.opt.disableVirtualHost {
-		req.SetHost(c.Addr)
+	// keep the original request to replay it if retry is possible.
+	var orig *fasthttp.Request
+	if p.opt.retry != nil && p.opt.retry.allowRequest(req) {
+		orig = fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(orig)
+		req.CopyTo(orig)
 	}
 
-	// execute the request and rev response with timeout
-	if err := p.doWithTimeout(c, req, res); err != nil {
-		errorF(p.opt.logger, "p.doWithTimeout failed, err = %v, status = %d", err, res.StatusCode())
-		res.SetStatusCode(http.StatusInternalServerError)
-		if errors.Is(err, fasthttp.ErrTimeout) {
-			res.SetStatusCode(http.StatusRequestTimeout)
+	var (
+		c     *upstream
+		err   error
+		tried []*upstream
+	)
+	hedge := p.opt.hedging != nil && !p.opt.streamResponseBody && p.opt.hedging.allowRequest(req)
+	for attempt := 1; ; attempt++ {
+		next, pickErr := p.pickUpstream(ctx, &tried)
+		if pickErr != nil {
+			c, err = next.u, pickErr
+			break
+		}
+		if next.u == nil {
+			if c == nil {
+				err = ErrNoUpstream
+			}
+			// no more upstream to retry, keep the last result.
+			break
+		}
+
+		if attempt > 1 {
+			orig.CopyTo(req)
+			res.Reset()
 		}
 
-		res.SetBody([]byte(err.Error()))
+		if hedge {
+			c, err = p.doHedged(ctx, next, req, res, &tried)
+		} else {
+			c, err = next.u, p.send(next, req, res)
+		}
+		if orig == nil || !p.opt.retry.retryable(attempt, res.StatusCode(), err) {
+			break
+		}
+
+		debugF(p.opt.debug, p.opt.logger, "retry request, attempt = %d, addr = %s, status = %d, err = %v",
+			attempt, c.Addr, res.StatusCode(), err)
+		p.opt.retry.wait(attempt)
+	}
+
+	if err != nil {
+		upstreamAddr := ""
+		if c != nil {
+			upstreamAddr = c.Addr
+		}
+		p.handleError(ctx, upstreamAddr, err)
 		return
 	}
 
 	// deal with response headers
 	debugF(p.opt.debug, p.opt.logger, "rev response headers from proxy, addr = %s, headers = %s", c.Addr, res.Header.String())
 
-	for _, h := range hopHeaders {
-		res.Header.Del(h)
+	removeHopHeaders(&res.Header)
+	addVia(&res.Header, res.Header.IsHTTP11(), p.opt.via)
+
+	// let the user modify or reject the upstream response.
+	if p.opt.modifyResponse != nil {
+		if err := p.opt.modifyResponse(res, req, c.Addr); err != nil {
+			p.handleError(ctx, c.Addr, &ProxyError{Kind: ErrorKindResponse, Upstream: c.Addr, Err: err})
+			return
+		}
 	}
+
+	p.setStickyCookie(ctx, c)
+}
+
+// pick is an upstream chosen to send the request to.
+type pick struct {
+	u     *upstream
+	dist  distribution
+	probe bool
+}
+
+// pickUpstream chooses an upstream not in tried to send the request to, and
+// appends it to tried. The upstreams rejected by circuit breaker are skipped
+// if failover is enabled, otherwise the error is returned with the rejected
+// upstream. The zero pick means there is no upstream available.
+func (p *ReverseProxy) pickUpstream(ctx *fasthttp.RequestCtx, tried *[]*upstream) (pick, error) {
+	for {
+		next, dist := p.distribute(ctx, *tried)
+		if next != nil && next.Addr == "" {
+			// reset by pool
+			next.inflight.Add(-1)
+			dist.done(0, nil)
+			next = nil
+		}
+		if next == nil {
+			return pick{}, nil
+		}
+		*tried = append(*tried, next)
+
+		allowed, probe := p.allowBreaker(next)
+		if allowed {
+			return pick{u: next, dist: dist, probe: probe}, nil
+		}
+
+		next.inflight.Add(-1)
+		dist.done(0, nil)
+		if !p.opt.circuitBreaker.Failover {
+			return pick{u: next}, &ProxyError{Kind: ErrorKindCircuitOpen, Upstream: next.Addr, Err: ErrCircuitOpen}
+		}
+	}
+}
+
+// send sends req to the picked upstream, and reports the result to balancer,
+// circuit breaker and hedging.
+func (p *ReverseProxy) send(pk pick, req *fasthttp.Request, res *fasthttp.Response) error {
+	start := time.Now()
+	err := p.do(pk.u, req, res)
+	elapsed := time.Since(start)
+
+	pk.dist.done(elapsed, err)
+	p.recordBreaker(pk.u, pk.probe, res.StatusCode(), err)
+	if p.opt.hedging != nil && err == nil {
+		p.opt.hedging.observe(elapsed)
+	}
+
+	return err
 }
 
-// doWithTimeout calls fasthttp.HostClient Do or DoTimeout, this is depends on p.opt.timeout
+// do sends the request to upstream c and receives the response.
+func (p *ReverseProxy) do(c *upstream, req *fasthttp.Request, res *fasthttp.Response) error {
+	// assign the host to support virtual hosting, aka shared web hosting (one IP, multiple domains)
+	if !p.opt.disableVirtualHost {
+		req.SetHost(c.Addr)
+	}
+
+	// HostClient refuses the request whose scheme differs from upstream.
+	if c.IsTLS {
+		req.URI().SetScheme("https")
+	} else {
+		req.URI().SetScheme("http")
+	}
+
+	// rewrite the path, and join it with the base path of upstream.
+	p.rewritePath(req, c.basePath)
+
+	// let the director rewrite the request before sending it to upstream.
+	if p.opt.director != nil {
+		p.opt.director(req, c.Addr)
+	}
+	debugF(p.opt.debug, p.opt.logger, "rev request headers to proxy, addr = %s, headers = %s", c.Addr, req.Header.String())
+
+	// execute the request and rev response with timeout
+	c.requests.Add(1)
+	err := p.doWithTimeout(c.HostClient, req, res)
+	c.inflight.Add(-1)
+	if err != nil || res.StatusCode() >= fasthttp.StatusInternalServerError {
+		c.failures.Add(1)
+	}
+	p.observeOutlier(c, res.StatusCode(), err)
+
+	return err
+}
+
+// handleError logs the error and passes it to the error handler, if err is not
+// a *ProxyError, it would be classified and wrapped.
+func (p *ReverseProxy) handleError(ctx *fasthttp.RequestCtx, upstream string, err error) {
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) {
+		proxyErr = newProxyError(upstream, err)
+	}
+
+	errorF(p.opt.logger, "proxy request failed, err = %v, kind = %s", proxyErr.Err, proxyErr.Kind)
+	p.opt.errorHandler(ctx, upstream, proxyErr)
+}
+
+// doWithTimeout calls fasthttp.HostClient Do or DoTimeout, this is depends on p.opt.timeout,
+// it would be overridden by the per-try timeout of retry policy.
 func (p *ReverseProxy) doWithTimeout(pc *fasthttp.HostClient, req *fasthttp.Request, res *fasthttp.Response) error {
-	if p.opt.timeout <= 0 {
+	timeout := p.opt.timeout
+	if p.opt.retry != nil && p.opt.retry.PerTryTimeout > 0 {
+		timeout = p.opt.retry.PerTryTimeout
+	}
+
+	if timeout <= 0 {
 		return pc.Do(req, res)
 	}
 
-	return pc.DoTimeout(req, res, p.opt.timeout)
+	return pc.DoTimeout(req, res, timeout)
 }
 
 // SetClient ...
 func (p *ReverseProxy) SetClient(addr string) *ReverseProxy {
-	for idx := range p.clients {
-		p.clients[idx].Addr = addr
+	for idx := range p.upstreams {
+		p.upstreams[idx].Addr = addr
 	}
 	return p
 }
 
 // Reset ...
 func (p *ReverseProxy) Reset() {
-	for idx := range p.clients {
-		p.clients[idx].Addr = ""
+	for idx := range p.upstreams {
+		p.upstreams[idx].Addr = ""
 	}
 }
 
 // Close ... clear and release
 func (p *ReverseProxy) Close() {
-	p.clients = nil
-	p.opt = nil
+	if p.done != nil {
+		close(p.done)
+		p.wg.Wait()
+		p.done = nil
+	}
+
+	p.mutex.Lock()
+	p.upstreams = nil
+	p.available = nil
 	p.bla = nil
-	p = nil
+	p.mutex.Unlock()
+	p.opt = nil
 }
 
 //
@@ -222,9 +505,9 @@ func (p *ReverseProxy) Close() {
 
 // Hop-by-hop headers. These are removed when sent to the backend.
 // As of RFC 7230, hop-by-hop headers are required to appear in the
-// Connection header field. These are the headers defined by the
-// obsoleted RFC 2616 (section 13.5.1) and are used for backward
-// compatibility.
+// Connection header field, and they're removed by removeHopHeaders too.
+// These are the headers defined by the obsoleted RFC 2616 (section 13.5.1)
+// and are used for backward compatibility.
 var hopHeaders = []string{
 	"Connection",          // Connection
 	"Proxy-Connection",    // non-standard but still sent by libcurl and rejected by e.g. google
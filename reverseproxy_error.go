@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	// ErrNoUpstream is the error resulting if there is no upstream available
+	// to serve the request.
+	ErrNoUpstream = errors.New("no upstream available")
+
+	// ErrCircuitOpen is the error resulting if the circuit breaker of chosen
+	// upstream is open.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// ErrorKind classifies the errors happened while proxying a request.
+type ErrorKind uint8
+
+const (
+	// ErrorKindUnknown denotes the error could not be classified.
+	ErrorKindUnknown ErrorKind = iota
+	// ErrorKindDial denotes the connection to upstream could not be established.
+	ErrorKindDial
+	// ErrorKindConnReset denotes the connection was reset or closed by upstream
+	// before the response was received.
+	ErrorKindConnReset
+	// ErrorKindTimeout denotes upstream did not respond in time.
+	ErrorKindTimeout
+	// ErrorKindNoUpstream denotes there is no upstream available.
+	ErrorKindNoUpstream
+	// ErrorKindResponse denotes the upstream response was rejected by ModifyResponse.
+	ErrorKindResponse
+	// ErrorKindCircuitOpen denotes the circuit breaker of upstream is open.
+	ErrorKindCircuitOpen
+)
+
+// String returns the name of ErrorKind.
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindDial:
+		return "dial"
+	case ErrorKindConnReset:
+		return "conn_reset"
+	case ErrorKindTimeout:
+		return "timeout"
+	case ErrorKindNoUpstream:
+		return "no_upstream"
+	case ErrorKindResponse:
+		return "response"
+	case ErrorKindCircuitOpen:
+		return "circuit_open"
+	}
+
+	return "unknown"
+}
+
+// StatusCode returns the HTTP status code which a gateway should respond
+// to the client with.
+func (k ErrorKind) StatusCode() int {
+	switch k {
+	case ErrorKindTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorKindNoUpstream, ErrorKindCircuitOpen:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadGateway
+}
+
+// ProxyError is the error passed to ErrorHandler, it contains the kind of
+// error and the upstream which the request was sent to.
+type ProxyError struct {
+	// Kind of the error.
+	Kind ErrorKind
+	// Upstream address, it's empty if no upstream has been chosen.
+	Upstream string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error interface.
+func (e *ProxyError) Error() string {
+	if e.Upstream == "" {
+		return "proxy: " + e.Kind.String() + ": " + e.Err.Error()
+	}
+
+	return "proxy: " + e.Kind.String() + " " + e.Upstream + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// newProxyError creates a ProxyError, the kind is classified from err.
+func newProxyError(upstream string, err error) *ProxyError {
+	return &ProxyError{
+		Kind:     classifyError(err),
+		Upstream: upstream,
+		Err:      err,
+	}
+}
+
+// classifyError classifies the error returned by fasthttp.HostClient.
+func classifyError(err error) ErrorKind {
+	if err == nil {
+		return ErrorKindUnknown
+	}
+
+	if errors.Is(err, ErrNoUpstream) || errors.Is(err, fasthttp.ErrNoFreeConns) {
+		return ErrorKindNoUpstream
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return ErrorKindCircuitOpen
+	}
+
+	// dialing timeout means the connection was never established.
+	if errors.Is(err, fasthttp.ErrDialTimeout) || errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorKindDial
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrorKindDial
+	}
+
+	var netErr net.Error
+	if errors.Is(err, fasthttp.ErrTimeout) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorKindTimeout
+	}
+
+	if errors.Is(err, fasthttp.ErrConnectionClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorKindConnReset
+	}
+
+	return ErrorKindUnknown
+}
+
+// ErrorHandler handles the errors happened while proxying a request,
+// it should write the response to the client.
+type ErrorHandler func(ctx *fasthttp.RequestCtx, upstream string, err *ProxyError)
+
+// DefaultErrorHandler responds the client with gateway status code of
+// the error kind. The error message is not written to the response since
+// it may leak internal addresses.
+func DefaultErrorHandler(ctx *fasthttp.RequestCtx, _ string, err *ProxyError) {
+	code := err.Kind.StatusCode()
+
+	ctx.Response.Reset()
+	ctx.Response.SetStatusCode(code)
+	ctx.Response.SetBodyString(http.StatusText(code))
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_classifyError(t *testing.T) {
+	testCases := []struct {
+		desc string
+		err  error
+		want ErrorKind
+	}{
+		{desc: "no upstream", err: ErrNoUpstream, want: ErrorKindNoUpstream},
+		{desc: "no free conns", err: fasthttp.ErrNoFreeConns, want: ErrorKindNoUpstream},
+		{desc: "circuit open", err: ErrCircuitOpen, want: ErrorKindCircuitOpen},
+		{desc: "dial timeout", err: fasthttp.ErrDialTimeout, want: ErrorKindDial},
+		{
+			desc: "connection refused",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			want: ErrorKindDial,
+		},
+		{desc: "timeout", err: fasthttp.ErrTimeout, want: ErrorKindTimeout},
+		{desc: "connection closed", err: fasthttp.ErrConnectionClosed, want: ErrorKindConnReset},
+		{
+			desc: "connection reset",
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			want: ErrorKindConnReset,
+		},
+		{desc: "wrapped", err: fmt.Errorf("wrapped: %w", fasthttp.ErrTimeout), want: ErrorKindTimeout},
+		{desc: "unknown", err: errors.New("unknown"), want: ErrorKindUnknown},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.want, classifyError(tC.err))
+		})
+	}
+}
+
+func Test_ReverseProxy_DefaultErrorHandler(t *testing.T) {
+	// find a port nobody is listening on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	slowAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	testCases := []struct {
+		desc  string
+		proxy func() *ReverseProxy
+		want  int
+	}{
+		{
+			desc: "dial failure",
+			proxy: func() *ReverseProxy {
+				p, _ := NewReverseProxyWith(WithAddress(closedAddr))
+				return p
+			},
+			want: fasthttp.StatusBadGateway,
+		},
+		{
+			desc: "upstream timeout",
+			proxy: func() *ReverseProxy {
+				p, _ := NewReverseProxyWith(WithAddress(slowAddr), WithTimeout(50*time.Millisecond))
+				return p
+			},
+			want: fasthttp.StatusGatewayTimeout,
+		},
+		{
+			desc: "no upstream",
+			proxy: func() *ReverseProxy {
+				p, _ := NewReverseProxyWith(WithAddress(slowAddr))
+				p.Reset()
+				return p
+			},
+			want: fasthttp.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+			tC.proxy().ServeHTTP(ctx)
+
+			assert.Equal(t, tC.want, ctx.Response.StatusCode())
+			assert.NotContains(t, string(ctx.Response.Body()), "127.0.0.1")
+		})
+	}
+}
+
+func Test_ReverseProxy_WithErrorHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	var got *ProxyError
+	proxy, err := NewReverseProxyWith(
+		WithAddress(closedAddr),
+		WithErrorHandler(func(ctx *fasthttp.RequestCtx, upstream string, err *ProxyError) {
+			got = err
+			ctx.Error("branded error", fasthttp.StatusTeapot)
+		}),
+	)
+	assert.Nil(t, err)
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	proxy.ServeHTTP(ctx)
+
+	assert.Equal(t, fasthttp.StatusTeapot, ctx.Response.StatusCode())
+	assert.Equal(t, "branded error", string(ctx.Response.Body()))
+	if assert.NotNil(t, got) {
+		assert.Equal(t, ErrorKindDial, got.Kind)
+		assert.Equal(t, closedAddr, got.Upstream)
+	}
+}
@@ -2,7 +2,10 @@ package proxy
 
 import (
 	"crypto/tls"
+	"regexp"
 	"time"
+
+	"github.com/valyala/fasthttp"
 )
 
 // Option to define all options to reverse http proxy.
@@ -31,6 +34,19 @@ type buildOption struct {
 	// need TLS handshake
 	tlsConfig *tls.Config
 
+	// clientCert is the client certificate presented to upstreams for mTLS.
+	clientCert *certReloader
+
+	// rootCAs is the CA pool to verify the certificates of upstreams.
+	rootCAs *caReloader
+
+	// insecureSkipVerify skips verifying the certificates of upstreams.
+	insecureSkipVerify bool
+
+	// upstreamConfigs keeps the configs of upstreams by address, which
+	// override the global settings such as tlsConfig.
+	upstreamConfigs map[string]*UpstreamConfig
+
 	// timeout specify the timeout context with each request.
 	timeout time.Duration
 
@@ -48,8 +64,74 @@ type buildOption struct {
 
 	// maxConnDuration of hostClient
 	maxConnDuration time.Duration
+
+	// director rewrites the outbound request before it is sent to upstream.
+	director Director
+
+	// modifyResponse modifies or rejects the response from upstream.
+	modifyResponse ModifyResponse
+
+	// errorHandler handles the errors happened while proxying a request.
+	errorHandler ErrorHandler
+
+	// healthCheck configures active health checking, nil means disabled.
+	healthCheck *HealthCheck
+
+	// outlierDetection configures passive outlier detection, nil means disabled.
+	outlierDetection *OutlierDetection
+
+	// retry configures retrying failed requests, nil means disabled.
+	retry *RetryPolicy
+
+	// discoverer pushes the updates of upstream set, nil means disabled.
+	discoverer Discoverer
+
+	// balancerFactory constructs balancer with weights of available upstreams.
+	balancerFactory BalancerFactory
+
+	// stickySession configures cookie-based session affinity, nil means disabled.
+	stickySession *StickySession
+
+	// forwardedHeaders configures the headers carrying the information of client.
+	forwardedHeaders *ForwardedHeaders
+
+	// circuitBreaker configures the circuit breaker of each upstream, nil means disabled.
+	circuitBreaker *CircuitBreaker
+
+	// hedging configures hedged requests, nil means disabled.
+	hedging *hedger
+
+	// mirror configures mirroring requests to a shadow upstream, nil means disabled.
+	mirror *mirror
+
+	// via is the pseudonym of proxy in Via header, empty means Via is not added.
+	via string
+
+	// err is the error happened while applying options, it's returned by
+	// NewReverseProxyWith.
+	err error
+
+	// stripPrefixes are stripped from the path of request, the first matched one wins.
+	stripPrefixes []string
+
+	// addPrefix is added to the path of request.
+	addPrefix string
+
+	// pathRewrite rewrites the path of request with regular expression.
+	pathRewrite *pathRewrite
 }
 
+// Director is used to rewrite the outbound request, such as path, query,
+// method or headers, before it's sent to the chosen upstream server.
+// ref to: https://golang.org/pkg/net/http/httputil/#ReverseProxy.Director
+type Director func(req *fasthttp.Request, upstream string)
+
+// ModifyResponse is used to modify the response from upstream, such as
+// rewriting headers or body. If it returns an error, the response will be
+// discarded and the error will be handled as an upstream failure.
+// ref to: https://golang.org/pkg/net/http/httputil/#ReverseProxy.ModifyResponse
+type ModifyResponse func(res *fasthttp.Response, req *fasthttp.Request, upstream string) error
+
 func defaultBuildOption() *buildOption {
 	return &buildOption{
 		logger:                 &nopLogger{},
@@ -58,10 +140,31 @@ func defaultBuildOption() *buildOption {
 		weights:                nil,
 		addresses:              nil,
 		tlsConfig:              nil,
+		clientCert:             nil,
+		rootCAs:                nil,
+		insecureSkipVerify:     false,
+		upstreamConfigs:        nil,
 		timeout:                0,
 		disablePathNormalizing: false,
 		disableVirtualHost:     false,
 		maxConnDuration:        0,
+		director:               nil,
+		modifyResponse:         nil,
+		errorHandler:           DefaultErrorHandler,
+		healthCheck:            nil,
+		outlierDetection:       nil,
+		retry:                  nil,
+		discoverer:             nil,
+		balancerFactory:        NewBalancer,
+		stickySession:          nil,
+		stripPrefixes:          nil,
+		addPrefix:              "",
+		pathRewrite:            nil,
+		forwardedHeaders:       defaultForwardedHeaders(),
+		circuitBreaker:         nil,
+		hedging:                nil,
+		mirror:                 nil,
+		via:                    "",
 	}
 }
 
@@ -78,20 +181,61 @@ func WithTLSConfig(config *tls.Config) Option {
 	})
 }
 
-// WithTLS build tls.Config with server certFile and keyFile.
-// tlsConfig is nil as default
+// WithTLS build tls.Config with certFile and keyFile, the certificate is
+// presented to upstreams as client certificate.
+//
+// Deprecated: use WithUpstreamClientCert instead, and use WithUpstreamRootCAs
+// to trust the certificate of upstream. The error of loading certificate is
+// returned by NewReverseProxyWith.
 func WithTLS(certFile, keyFile string) Option {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		panic("" + err.Error())
-	}
+	return WithUpstreamClientCert(certFile, keyFile)
+}
 
-	return WithTLSConfig(&tls.Config{
-		Certificates: []tls.Certificate{cert},
+// WithUpstreamClientCert loads the client certificate presented to upstreams
+// for mTLS from certFile and keyFile. The files are reloaded when they're
+// changed, so the certificate could be rotated without restart. The error of
+// loading certificate is returned by NewReverseProxyWith.
+// TLS is enabled for upstreams whose address has no scheme. It's not used for
+// the upstreams with TLSConfig of UpstreamConfig, which overrides it.
+func WithUpstreamClientCert(certFile, keyFile string) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.clientCert = reloader
 	})
 }
 
-// WithAddress generate address options
+// WithUpstreamRootCAs loads the CA pool from PEM files to verify the certificates
+// of upstreams, instead of the system pool. The files are reloaded when they're
+// changed. The error of loading CA is returned by NewReverseProxyWith.
+// It takes precedence over RootCAs of UpstreamConfig, but it's not used for the
+// upstreams with TLSConfig of UpstreamConfig, which overrides it.
+// TLS is enabled for upstreams whose address has no scheme.
+func WithUpstreamRootCAs(pemFiles ...string) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		reloader, err := newCAReloader(pemFiles...)
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.rootCAs = reloader
+	})
+}
+
+// WithUpstreamInsecureSkipVerify skips verifying the certificates of upstreams,
+// it should only be used for development.
+// TLS is enabled for upstreams whose address has no scheme.
+func WithUpstreamInsecureSkipVerify() Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.insecureSkipVerify = true
+	})
+}
+
+// WithAddress generate address options, the address could be host:port or
+// URL like http://host:port/base, whose path is joined with the path of request.
 func WithAddress(addresses ...string) Option {
 	return newFuncBuildOption(func(o *buildOption) {
 		o.addresses = addresses
@@ -114,6 +258,30 @@ func WithBalancer(addrWeights map[string]Weight) Option {
 	})
 }
 
+// WithUpstreams generate balancer options with the config of each upstream,
+// so that the upstreams could have different scheme and TLS settings.
+func WithUpstreams(configs ...UpstreamConfig) Option {
+	weights := make([]W, 0, len(configs))
+	addresses := make([]string, 0, len(configs))
+	upstreamConfigs := make(map[string]*UpstreamConfig, len(configs))
+	for idx := range configs {
+		cfg := configs[idx]
+		if cfg.Weight == 0 {
+			cfg.Weight = 1
+		}
+		weights = append(weights, cfg.Weight)
+		addresses = append(addresses, cfg.Addr)
+		upstreamConfigs[cfg.Addr] = &cfg
+	}
+
+	return newFuncBuildOption(func(o *buildOption) {
+		o.addresses = addresses
+		o.openBalance = true
+		o.weights = weights
+		o.upstreamConfigs = upstreamConfigs
+	})
+}
+
 func WithDebug() Option {
 	return newFuncBuildOption(func(o *buildOption) {
 		o.debug = true
@@ -156,3 +324,164 @@ func WithMaxConnDuration(d time.Duration) Option {
 		o.maxConnDuration = d
 	})
 }
+
+// WithDirector specify a Director to rewrite the outbound request. It's called
+// after hop-by-hop headers are removed and the Host is set, so it has the final
+// say on what will be sent to upstream.
+func WithDirector(director Director) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.director = director
+	})
+}
+
+// WithModifyResponse specify a ModifyResponse to modify the response received
+// from upstream, it's called after hop-by-hop headers are removed.
+func WithModifyResponse(modifyResponse ModifyResponse) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.modifyResponse = modifyResponse
+	})
+}
+
+// WithErrorHandler specify an ErrorHandler to respond the client when the
+// request could not be proxied, DefaultErrorHandler is used as default.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		if handler == nil {
+			handler = DefaultErrorHandler
+		}
+		o.errorHandler = handler
+	})
+}
+
+// WithHealthCheck enables active health checking of upstream servers,
+// unhealthy upstreams will not be chosen until they recover.
+func WithHealthCheck(hc HealthCheck) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		hc = hc.withDefaults()
+		o.healthCheck = &hc
+	})
+}
+
+// WithOutlierDetection enables passive outlier detection, upstreams which fail
+// consecutively will be ejected from balancer for a while.
+func WithOutlierDetection(od OutlierDetection) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		od = od.withDefaults()
+		o.outlierDetection = &od
+	})
+}
+
+// WithRetry enables retrying failed requests on another upstream.
+func WithRetry(rp RetryPolicy) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		rp = rp.withDefaults()
+		o.retry = &rp
+	})
+}
+
+// WithDiscoverer specify a Discoverer to feed the upstream set of ReverseProxy,
+// the addresses specified by WithAddress or WithBalancer are used until the
+// first update is pushed, and they could be omitted.
+func WithDiscoverer(d Discoverer) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.discoverer = d
+	})
+}
+
+// WithBalancerFactory specify the algorithm of balancer by BalancerFactory,
+// NewBalancer (weighted round-robin) is used as default.
+func WithBalancerFactory(factory BalancerFactory) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		if factory == nil {
+			factory = NewBalancer
+		}
+		o.balancerFactory = factory
+	})
+}
+
+// WithStickySession enables cookie-based session affinity, requests from the
+// same client are sent to the same upstream.
+func WithStickySession(ss StickySession) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		ss = ss.withDefaults()
+		o.stickySession = &ss
+	})
+}
+
+// WithStripPrefix strips the first matched prefix from the path of request
+// before it's sent to upstream, e.g. /api/users/1 becomes /users/1 with prefix
+// "/api". The prefixes match the escaped path by whole segments, so /apiv2 is
+// not stripped by "/api".
+func WithStripPrefix(prefixes ...string) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.stripPrefixes = prefixes
+	})
+}
+
+// WithAddPrefix adds prefix to the path of request before it's sent to upstream,
+// it's applied after WithStripPrefix and WithPathRewrite.
+func WithAddPrefix(prefix string) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.addPrefix = prefix
+	})
+}
+
+// WithPathRewrite replaces the path of request matching pattern with replacement
+// before it's sent to upstream, replacement could refer the submatches like
+// regexp.Regexp.ReplaceAllString. It's applied after WithStripPrefix and the
+// pattern matches the escaped path.
+func WithPathRewrite(pattern *regexp.Regexp, replacement string) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.pathRewrite = &pathRewrite{pattern: pattern, replacement: replacement}
+	})
+}
+
+// WithForwardedHeaders configures the headers carrying the information of client,
+// such as Forwarded and X-Forwarded-For. X-Forwarded-For is appended to the one
+// from any client as default. The error of parsing TrustedProxies is returned
+// by NewReverseProxyWith.
+func WithForwardedHeaders(fh ForwardedHeaders) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		parsed, err := fh.parse()
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.forwardedHeaders = &parsed
+	})
+}
+
+// WithVia adds the proxy to the Via header of request and response with
+// pseudonym, such as "fasthttp-reverse-proxy". Via is not added as default.
+func WithVia(pseudonym string) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.via = pseudonym
+	})
+}
+
+// WithCircuitBreaker enables the circuit breaker of each upstream, requests are
+// not sent to the upstream whose breaker is open.
+func WithCircuitBreaker(cb CircuitBreaker) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		cb = cb.withDefaults()
+		o.circuitBreaker = &cb
+	})
+}
+
+// WithHedging enables hedged requests, a copy of the idempotent request is sent
+// to another upstream if the chosen one has not responded in the delay, and the
+// response comes first is used. It's ignored if WithStreamResponseBody is used.
+func WithHedging(h Hedging) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.hedging = newHedger(h)
+	})
+}
+
+// WithMirror mirrors a copy of requests to the shadow upstream in background,
+// the response of shadow upstream is discarded. The error of parsing the address
+// of shadow upstream is returned by NewReverseProxyWith.
+func WithMirror(m Mirror) Option {
+	return newFuncBuildOption(func(o *buildOption) {
+		o.mirror = newMirror(m)
+	})
+}
@@ -4,7 +4,12 @@
 package proxy
 
 import (
+	"errors"
+	"net"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
 )
 
 func BenchmarkNewReverseProxy(b *testing.B) {
@@ -49,7 +54,7 @@ func Test_NewReverseProxy(t *testing.T) {
 		t.FailNow()
 	}
 
-	if client.Addr != "https://www.baidu.com" {
+	if client.Addr != "www.baidu.com" || !client.IsTLS || client.String() != "https://www.baidu.com" {
 		t.Error("wrong init hostclient addr")
 		t.FailNow()
 	}
@@ -78,3 +83,94 @@ func Test_NewReversePorxyWithBalancer(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// newTestUpstream starts a fasthttp server on a random local port and returns its address.
+func newTestUpstream(t *testing.T, handler fasthttp.RequestHandler) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	server := &fasthttp.Server{Handler: handler}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return ln.Addr().String()
+}
+
+// newTestRequestCtx creates a RequestCtx as if it was received from a client.
+func newTestRequestCtx(method, uri string) *fasthttp.RequestCtx {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}, nil)
+	return ctx
+}
+
+func Test_ReverseProxy_WithDirector(t *testing.T) {
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Path", string(ctx.Path()))
+		ctx.Response.Header.Set("X-Method", string(ctx.Method()))
+		ctx.Response.Header.Set("X-Upstream", string(ctx.Request.Header.Peek("X-Upstream")))
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithAddress(addr),
+		WithDirector(func(req *fasthttp.Request, upstream string) {
+			req.URI().SetPath("/rewritten")
+			req.Header.SetMethod(fasthttp.MethodPost)
+			req.Header.Set("X-Upstream", upstream)
+		}),
+	)
+	assert.Nil(t, err)
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/origin")
+	proxy.ServeHTTP(ctx)
+
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "/rewritten", string(ctx.Response.Header.Peek("X-Path")))
+	assert.Equal(t, fasthttp.MethodPost, string(ctx.Response.Header.Peek("X-Method")))
+	assert.Equal(t, addr, string(ctx.Response.Header.Peek("X-Upstream")))
+}
+
+func Test_ReverseProxy_WithModifyResponse(t *testing.T) {
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Internal", "secret")
+		if string(ctx.Path()) == "/fail" {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		ctx.SetBodyString("upstream")
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithAddress(addr),
+		WithModifyResponse(func(res *fasthttp.Response, req *fasthttp.Request, upstream string) error {
+			if res.StatusCode() >= fasthttp.StatusInternalServerError {
+				return errors.New("upstream failed")
+			}
+
+			res.Header.Del("X-Internal")
+			res.Header.Set("X-Frame-Options", "DENY")
+			res.SetBodyString("modified by " + upstream)
+			return nil
+		}),
+	)
+	assert.Nil(t, err)
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/ok")
+	proxy.ServeHTTP(ctx)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Empty(t, ctx.Response.Header.Peek("X-Internal"))
+	assert.Equal(t, "DENY", string(ctx.Response.Header.Peek("X-Frame-Options")))
+	assert.Equal(t, "modified by "+addr, string(ctx.Response.Body()))
+
+	ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/fail")
+	proxy.ServeHTTP(ctx)
+	assert.Equal(t, fasthttp.StatusBadGateway, ctx.Response.StatusCode())
+	assert.Empty(t, ctx.Response.Header.Peek("X-Internal"))
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// pathRewrite rewrites the path matching pattern with replacement.
+type pathRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// rewritePath rewrites the path of req with the rules of options, and then
+// joins it with basePath of upstream. The escaped form of path is rewritten,
+// the escaped characters such as %2F are sent as they're only if
+// WithDisablePathNormalizing(true) is used, otherwise HostClient normalizes
+// the path and %2F becomes a slash.
+func (p *ReverseProxy) rewritePath(req *fasthttp.Request, basePath string) {
+	if len(p.opt.stripPrefixes) == 0 && p.opt.pathRewrite == nil &&
+		p.opt.addPrefix == "" && basePath == "" {
+		return
+	}
+
+	path := string(req.URI().PathOriginal())
+	if path == "" {
+		path = "/"
+	}
+
+	for _, prefix := range p.opt.stripPrefixes {
+		if hasPathPrefix(path, prefix) {
+			path = path[len(prefix):]
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			break
+		}
+	}
+
+	if rw := p.opt.pathRewrite; rw != nil {
+		path = rw.pattern.ReplaceAllString(path, rw.replacement)
+	}
+
+	if p.opt.addPrefix != "" {
+		path = singleJoiningSlash(p.opt.addPrefix, path)
+	}
+	if basePath != "" {
+		path = singleJoiningSlash(basePath, path)
+	}
+
+	req.URI().SetPath(path)
+}
+
+// hasPathPrefix reports whether prefix matches path by whole segments, e.g.
+// /api matches /api and /api/users, but not /apiv2.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// singleJoiningSlash joins a and b with exactly one slash between them.
+// ref to: https://golang.org/src/net/http/httputil/reverseproxy.go
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
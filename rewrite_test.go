@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_singleJoiningSlash(t *testing.T) {
+	assert.Equal(t, "/base/users", singleJoiningSlash("/base", "/users"))
+	assert.Equal(t, "/base/users", singleJoiningSlash("/base/", "/users"))
+	assert.Equal(t, "/base/users", singleJoiningSlash("/base", "users"))
+	assert.Equal(t, "/base/", singleJoiningSlash("/base", "/"))
+	assert.Equal(t, "/users", singleJoiningSlash("/", "/users"))
+}
+
+func Test_ReverseProxy_rewritePath(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		options  []Option
+		basePath string
+		uri      string
+		want     string
+	}{
+		{desc: "nothing", uri: "/api/users?id=1", want: "/api/users?id=1"},
+		{desc: "base path", basePath: "/base", uri: "/users?id=1", want: "/base/users?id=1"},
+		{desc: "strip prefix", options: []Option{WithStripPrefix("/v1", "/api")}, uri: "/api/users", want: "/users"},
+		{desc: "strip whole path", options: []Option{WithStripPrefix("/api")}, uri: "/api", want: "/"},
+		{desc: "strip not matched", options: []Option{WithStripPrefix("/api")}, uri: "/users", want: "/users"},
+		{desc: "strip partial segment", options: []Option{WithStripPrefix("/api")}, uri: "/apiv2/users", want: "/apiv2/users"},
+		{desc: "strip prefix with slash", options: []Option{WithStripPrefix("/api/")}, uri: "/api/users", want: "/users"},
+		{desc: "add prefix", options: []Option{WithAddPrefix("/v2/")}, uri: "/users", want: "/v2/users"},
+		{
+			desc:    "rewrite",
+			options: []Option{WithPathRewrite(regexp.MustCompile(`^/users/(\d+)$`), "/user?id=$1")},
+			uri:     "/users/42",
+			want:    "/user%3Fid=42",
+		},
+		{
+			desc: "all",
+			options: []Option{
+				WithStripPrefix("/api"),
+				WithPathRewrite(regexp.MustCompile(`^/u/`), "/users/"),
+				WithAddPrefix("/v2"),
+			},
+			basePath: "/base/",
+			uri:      "/api/u/1",
+			want:     "/base/v2/users/1",
+		},
+		{
+			desc:     "escaped",
+			options:  []Option{WithDisablePathNormalizing(true), WithStripPrefix("/api")},
+			basePath: "/base%20path",
+			uri:      "/api/a%2Fb",
+			want:     "/base%20path/a%2Fb",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			proxy, err := NewReverseProxyWith(append([]Option{WithAddress("localhost:8080")}, tC.options...)...)
+			assert.Nil(t, err)
+			defer proxy.Close()
+
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			req.SetRequestURI(tC.uri)
+			// HostClient does the same before sending the request.
+			req.URI().DisablePathNormalizing = proxy.opt.disablePathNormalizing
+
+			proxy.rewritePath(req, tC.basePath)
+			assert.Equal(t, tC.want, string(req.RequestURI()))
+		})
+	}
+}
+
+func Test_ReverseProxy_WithBasePath(t *testing.T) {
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBody(ctx.RequestURI())
+	})
+
+	proxy, err := NewReverseProxyWith(
+		WithAddress("http://"+addr+"/base"),
+		WithStripPrefix("/api"),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/api/users/1?q=x")
+	proxy.ServeHTTP(ctx)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "/base/users/1?q=x", string(ctx.Response.Body()))
+}
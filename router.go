@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// _routeNameKey is the key of user value which keeps the name of matched route.
+const _routeNameKey = "fasthttp-reverse-proxy.route"
+
+// Handler is the interface implemented by ReverseProxy, WSReverseProxy, Router,
+// Canary and RateLimiter.
+type Handler interface {
+	ServeHTTP(ctx *fasthttp.RequestCtx)
+}
+
+// Rule describes the requests a route matches, all the non-empty conditions
+// must be matched.
+type Rule struct {
+	// Host matches the Host header (port is ignored) case-insensitively, it
+	// could be a wildcard like "*.example.com", which matches any subdomain
+	// of example.com but not example.com itself.
+	Host string
+	// Path matches the request path exactly.
+	Path string
+	// PathPrefix matches the prefix of request path by whole segments, e.g.
+	// "/api" matches "/api" and "/api/users", but not "/apiv2".
+	PathPrefix string
+	// PathRegexp matches the request path with regular expression.
+	PathRegexp string
+	// Methods matches any of the request methods.
+	Methods []string
+	// Headers matches the request headers, empty value means the header
+	// must be present with any value.
+	Headers map[string]string
+	// Priority of the route, routes with higher priority are matched first,
+	// and routes with the same priority are matched in the order they're added.
+	Priority int
+}
+
+// route is a compiled Rule with its backend.
+type route struct {
+	name    string
+	rule    Rule
+	host    string
+	pathRe  *regexp.Regexp
+	backend Handler
+}
+
+// match reports whether the request matches the route.
+func (rt *route) match(ctx *fasthttp.RequestCtx) bool {
+	if rt.host != "" && !matchHost(rt.host, ctx.Host()) {
+		return false
+	}
+
+	path := ctx.Path()
+	if rt.rule.Path != "" && string(path) != rt.rule.Path {
+		return false
+	}
+	if rt.rule.PathPrefix != "" && !hasPathPrefix(string(path), rt.rule.PathPrefix) {
+		return false
+	}
+	if rt.pathRe != nil && !rt.pathRe.Match(path) {
+		return false
+	}
+
+	if len(rt.rule.Methods) != 0 {
+		matched := false
+		for _, method := range rt.rule.Methods {
+			if strings.EqualFold(method, string(ctx.Method())) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for name, value := range rt.rule.Headers {
+		got := ctx.Request.Header.Peek(name)
+		if got == nil || (value != "" && string(got) != value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchHost matches host (with optional port) with pattern, which is lower-case.
+func matchHost(pattern string, host []byte) bool {
+	h := strings.ToLower(string(host))
+	if idx := strings.LastIndexByte(h, ':'); idx >= 0 && !strings.HasSuffix(h, "]") {
+		h = h[:idx]
+	}
+
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return len(h) > len(suffix) && strings.HasSuffix(h, suffix)
+	}
+
+	return h == pattern
+}
+
+// Router routes requests to named backends (ReverseProxy or WSReverseProxy)
+// by Host, path, method and headers. It's safe to add routes while serving.
+type Router struct {
+	mutex    sync.RWMutex
+	routes   []*route
+	fallback Handler
+}
+
+// NewRouter creates an empty Router.
+func NewRouter() *Router {
+	return &Router{
+		routes: make([]*route, 0, 8),
+	}
+}
+
+// Handle adds a route named name, requests matching rule are served by backend.
+func (r *Router) Handle(name string, rule Rule, backend Handler) error {
+	if backend == nil {
+		return errors.New("backend is nil")
+	}
+
+	rt := &route{
+		name:    name,
+		rule:    rule,
+		host:    strings.ToLower(rule.Host),
+		backend: backend,
+	}
+	if rule.PathRegexp != "" {
+		re, err := regexp.Compile(rule.PathRegexp)
+		if err != nil {
+			return err
+		}
+		rt.pathRe = re
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.routes = append(r.routes, rt)
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return r.routes[i].rule.Priority > r.routes[j].rule.Priority
+	})
+
+	return nil
+}
+
+// SetDefault sets the backend to serve requests matching no route, the
+// requests are responded with 404 if it's not set.
+func (r *Router) SetDefault(backend Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.fallback = backend
+}
+
+// ServeHTTP serves the request with the backend of first matched route.
+func (r *Router) ServeHTTP(ctx *fasthttp.RequestCtx) {
+	r.mutex.RLock()
+	var (
+		name    string
+		backend = r.fallback
+	)
+	for _, rt := range r.routes {
+		if rt.match(ctx) {
+			name, backend = rt.name, rt.backend
+			break
+		}
+	}
+	r.mutex.RUnlock()
+
+	if backend == nil {
+		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusNotFound), fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetUserValue(_routeNameKey, name)
+	backend.ServeHTTP(ctx)
+}
+
+// RouteName returns the name of route matched by Router, it's empty if the
+// request is served by default backend or not routed by Router.
+func RouteName(ctx *fasthttp.RequestCtx) string {
+	name, _ := ctx.UserValue(_routeNameKey).(string)
+	return name
+}
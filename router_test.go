@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// namedHandler responds with its name.
+type namedHandler string
+
+func (h namedHandler) ServeHTTP(ctx *fasthttp.RequestCtx) {
+	ctx.SetBodyString(string(h) + ":" + RouteName(ctx))
+}
+
+func Test_matchHost(t *testing.T) {
+	assert.True(t, matchHost("example.com", []byte("Example.com:8080")))
+	assert.True(t, matchHost("*.example.com", []byte("api.example.com")))
+	assert.True(t, matchHost("*.example.com", []byte("a.b.example.com:443")))
+	assert.False(t, matchHost("*.example.com", []byte("example.com")))
+	assert.False(t, matchHost("*.example.com", []byte("badexample.com")))
+	assert.True(t, matchHost("[::1]", []byte("[::1]")))
+}
+
+func Test_Router(t *testing.T) {
+	router := NewRouter()
+	assert.Nil(t, router.Handle("users", Rule{PathPrefix: "/api/users"}, namedHandler("users")))
+	assert.Nil(t, router.Handle("admin", Rule{
+		Host:     "*.example.com",
+		Path:     "/admin",
+		Methods:  []string{fasthttp.MethodPost},
+		Priority: 10,
+	}, namedHandler("admin")))
+	assert.Nil(t, router.Handle("orders", Rule{PathRegexp: `^/api/orders/\d+$`}, namedHandler("orders")))
+	assert.Nil(t, router.Handle("beta", Rule{
+		PathPrefix: "/api",
+		Headers:    map[string]string{"X-Beta": ""},
+		Priority:   5,
+	}, namedHandler("beta")))
+	assert.NotNil(t, router.Handle("invalid", Rule{PathRegexp: `(`}, namedHandler("invalid")))
+	assert.NotNil(t, router.Handle("nil", Rule{}, nil))
+
+	testCases := []struct {
+		desc    string
+		method  string
+		uri     string
+		headers map[string]string
+		want    string
+	}{
+		{desc: "prefix", method: fasthttp.MethodGet, uri: "http://example.com/api/users/1", want: "users:users"},
+		{desc: "prefix not matched", method: fasthttp.MethodGet, uri: "http://example.com/api/usersettings", want: ""},
+		{desc: "regexp", method: fasthttp.MethodGet, uri: "http://example.com/api/orders/42", want: "orders:orders"},
+		{desc: "regexp not matched", method: fasthttp.MethodGet, uri: "http://example.com/api/orders/abc", want: ""},
+		{desc: "host and method", method: fasthttp.MethodPost, uri: "http://www.example.com/admin", want: "admin:admin"},
+		{desc: "method not matched", method: fasthttp.MethodGet, uri: "http://www.example.com/admin", want: ""},
+		{
+			desc:    "header with priority",
+			method:  fasthttp.MethodGet,
+			uri:     "http://example.com/api/users/1",
+			headers: map[string]string{"X-Beta": "1"},
+			want:    "beta:beta",
+		},
+		{
+			desc:    "prefix by segments",
+			method:  fasthttp.MethodGet,
+			uri:     "http://example.com/apiv2/users",
+			headers: map[string]string{"X-Beta": "1"},
+			want:    "",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctx := newTestRequestCtx(tC.method, tC.uri)
+			for k, v := range tC.headers {
+				ctx.Request.Header.Set(k, v)
+			}
+			router.ServeHTTP(ctx)
+
+			if tC.want == "" {
+				assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+				return
+			}
+			assert.Equal(t, tC.want, string(ctx.Response.Body()))
+		})
+	}
+
+	router.SetDefault(namedHandler("default"))
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/unknown")
+	router.ServeHTTP(ctx)
+	assert.Equal(t, "default:", string(ctx.Response.Body()))
+}
+
+func Test_Router_ReverseProxy(t *testing.T) {
+	usersAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("users") })
+	ordersAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("orders") })
+
+	users, err := NewReverseProxyWith(WithAddress(usersAddr))
+	assert.Nil(t, err)
+	orders, err := NewReverseProxyWith(WithAddress(ordersAddr))
+	assert.Nil(t, err)
+
+	router := NewRouter()
+	assert.Nil(t, router.Handle("users", Rule{PathPrefix: "/users"}, users))
+	router.SetDefault(orders)
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/users/1")
+	router.ServeHTTP(ctx)
+	assert.Equal(t, "users", string(ctx.Response.Body()))
+
+	ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/orders/1")
+	router.ServeHTTP(ctx)
+	assert.Equal(t, "orders", string(ctx.Response.Body()))
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// StickySession configures cookie-based session affinity. An opaque cookie
+// identifying the upstream is set on the first response, and later requests
+// carrying the cookie are sent to the same upstream. If the upstream is gone
+// or unavailable, the request is distributed by balancer and the cookie is
+// issued again. The cookie value is an HMAC of the upstream address, so that
+// the address is not exposed to clients.
+type StickySession struct {
+	// CookieName is the name of affinity cookie, default is "fhrp_affinity".
+	CookieName string
+	// Path of cookie, default is "/".
+	Path string
+	// Domain of cookie, empty means the host of request.
+	Domain string
+	// TTL of cookie, it's a session cookie if TTL is 0. The cookie is refreshed
+	// on each response, so it expires TTL after the last request of client.
+	TTL time.Duration
+	// Secure sets the Secure attribute of cookie.
+	Secure bool
+	// HTTPOnly sets the HttpOnly attribute of cookie.
+	HTTPOnly bool
+	// SameSite sets the SameSite attribute of cookie.
+	SameSite fasthttp.CookieSameSite
+	// Secret is the key of HMAC to generate the cookie value, a random one is
+	// generated if it's empty. Multiple proxies must share the same Secret to
+	// agree on the cookies.
+	Secret []byte
+}
+
+// withDefaults fills the zero fields with default values.
+func (ss StickySession) withDefaults() StickySession {
+	if ss.CookieName == "" {
+		ss.CookieName = "fhrp_affinity"
+	}
+	if ss.Path == "" {
+		ss.Path = "/"
+	}
+	if len(ss.Secret) == 0 {
+		ss.Secret = make([]byte, 32)
+		// it never returns an error on supported platforms.
+		_, _ = rand.Read(ss.Secret)
+	}
+
+	return ss
+}
+
+// stickyID returns the opaque identity of upstream addr used as cookie value,
+// it's stable across processes with the same Secret so that multiple proxies
+// would agree on it.
+func (ss *StickySession) stickyID(addr string) string {
+	mac := hmac.New(sha256.New, ss.Secret)
+	mac.Write([]byte(addr))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// stickyUpstream finds the available upstream of the affinity cookie in ctx,
+// p.mutex must be held by caller.
+func (p *ReverseProxy) stickyUpstream(ctx *fasthttp.RequestCtx) *upstream {
+	ss := p.opt.stickySession
+	if ss == nil || ctx == nil {
+		return nil
+	}
+
+	value := ctx.Request.Header.Cookie(ss.CookieName)
+	if len(value) == 0 {
+		return nil
+	}
+
+	for _, u := range p.available {
+		if u.stickyID == string(value) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// setStickyCookie sets the affinity cookie of upstream u on response, if the
+// request does not carry it yet, or the cookie has TTL to refresh.
+func (p *ReverseProxy) setStickyCookie(ctx *fasthttp.RequestCtx, u *upstream) {
+	ss := p.opt.stickySession
+	if ss == nil {
+		return
+	}
+
+	id := u.stickyID
+	if ss.TTL <= 0 && string(ctx.Request.Header.Cookie(ss.CookieName)) == id {
+		return
+	}
+
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+
+	cookie.SetKey(ss.CookieName)
+	cookie.SetValue(id)
+	cookie.SetPath(ss.Path)
+	cookie.SetDomain(ss.Domain)
+	if ss.TTL > 0 {
+		cookie.SetMaxAge(int(ss.TTL / time.Second))
+	}
+	cookie.SetSecure(ss.Secure)
+	cookie.SetHTTPOnly(ss.HTTPOnly)
+	cookie.SetSameSite(ss.SameSite)
+
+	ctx.Response.Header.SetCookie(cookie)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_StickySession_stickyID(t *testing.T) {
+	ss := StickySession{Secret: []byte("secret")}.withDefaults()
+	assert.Equal(t, ss.stickyID("10.0.0.1:80"), ss.stickyID("10.0.0.1:80"))
+	assert.NotEqual(t, ss.stickyID("10.0.0.1:80"), ss.stickyID("10.0.0.2:80"))
+	assert.NotContains(t, ss.stickyID("10.0.0.1:80"), "10.0.0.1")
+
+	// the value could not be derived without the secret.
+	other := StickySession{Secret: []byte("other")}.withDefaults()
+	assert.NotEqual(t, ss.stickyID("10.0.0.1:80"), other.stickyID("10.0.0.1:80"))
+
+	// a random secret is generated if it's empty.
+	random1, random2 := StickySession{}.withDefaults(), StickySession{}.withDefaults()
+	assert.Len(t, random1.Secret, 32)
+	assert.NotEqual(t, random1.stickyID("10.0.0.1:80"), random2.stickyID("10.0.0.1:80"))
+}
+
+func Test_ReverseProxy_WithStickySession(t *testing.T) {
+	addrs := make([]string, 0, 3)
+	weights := make(map[string]Weight)
+	for i := 0; i < 3; i++ {
+		name := strconv.Itoa(i)
+		addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString(name) })
+		addrs = append(addrs, addr)
+		weights[addr] = 1
+	}
+
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(weights),
+		WithStickySession(StickySession{
+			CookieName: "affinity",
+			TTL:        time.Hour,
+			Secure:     true,
+			HTTPOnly:   true,
+			SameSite:   fasthttp.CookieSameSiteLaxMode,
+		}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	// the first response carries the affinity cookie.
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	proxy.ServeHTTP(ctx)
+	first := string(ctx.Response.Body())
+
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey("affinity")
+	assert.True(t, ctx.Response.Header.Cookie(cookie))
+	assert.Equal(t, "/", string(cookie.Path()))
+	assert.Equal(t, 3600, cookie.MaxAge())
+	assert.True(t, cookie.Secure())
+	assert.True(t, cookie.HTTPOnly())
+	assert.Equal(t, fasthttp.CookieSameSiteLaxMode, cookie.SameSite())
+	value := string(cookie.Value())
+
+	// later requests go to the same upstream, and the cookie is refreshed.
+	for i := 0; i < 10; i++ {
+		ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		ctx.Request.Header.SetCookie("affinity", value)
+		proxy.ServeHTTP(ctx)
+		assert.Equal(t, first, string(ctx.Response.Body()))
+		assert.True(t, ctx.Response.Header.Cookie(cookie))
+		assert.Equal(t, value, string(cookie.Value()))
+		assert.Equal(t, 3600, cookie.MaxAge())
+	}
+
+	// the upstream is gone, fall back to balancer and reissue the cookie.
+	idx, _ := strconv.Atoi(first)
+	assert.Nil(t, proxy.RemoveUpstream(addrs[idx]))
+
+	ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	ctx.Request.Header.SetCookie("affinity", value)
+	proxy.ServeHTTP(ctx)
+	assert.NotEqual(t, first, string(ctx.Response.Body()))
+	assert.True(t, ctx.Response.Header.Cookie(cookie))
+	assert.NotEqual(t, value, string(cookie.Value()))
+}
+
+func Test_ReverseProxy_WithStickySession_sessionCookie(t *testing.T) {
+	addr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {})
+	proxy, err := NewReverseProxyWith(
+		WithBalancer(map[string]Weight{addr: 1}),
+		WithStickySession(StickySession{CookieName: "affinity"}),
+	)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	proxy.ServeHTTP(ctx)
+	value := ctx.Response.Header.PeekCookie("affinity")
+	assert.NotEmpty(t, value)
+
+	// the session cookie is not set again.
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	assert.Nil(t, cookie.ParseBytes(value))
+
+	ctx = newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	ctx.Request.Header.SetCookieBytesKV([]byte("affinity"), cookie.Value())
+	proxy.ServeHTTP(ctx)
+	assert.Empty(t, ctx.Response.Header.PeekCookie("affinity"))
+}
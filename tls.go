@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// _certReloadInterval is the minimum interval to check whether the certificate
+// files have been changed.
+const _certReloadInterval = 10 * time.Second
+
+// fileVersion is the modification time and size of files, it's used to know
+// whether the files have been changed.
+type fileVersion []os.FileInfo
+
+func statFiles(files ...string) (fileVersion, error) {
+	version := make(fileVersion, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		version = append(version, info)
+	}
+
+	return version, nil
+}
+
+func (v fileVersion) equal(other fileVersion) bool {
+	if len(v) != len(other) {
+		return false
+	}
+	for idx := range v {
+		if !v[idx].ModTime().Equal(other[idx].ModTime()) || v[idx].Size() != other[idx].Size() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// certReloader keeps a certificate loaded from files, and reloads it when the
+// files are changed, so that the rotated certificate is used without restart.
+// The files are checked lazily when the certificate is used, at most once in
+// interval. The last good certificate is kept if the files could not be loaded.
+type certReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	version fileVersion
+	checked time.Time
+}
+
+// newCertReloader loads the certificate from certFile and keyFile.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: _certReloadInterval,
+	}
+	if err := r.reloadLocked(true); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reloadLocked loads the certificate again if the files have been changed or
+// force is true, r.mutex must be held by caller.
+func (r *certReloader) reloadLocked(force bool) error {
+	r.checked = time.Now()
+
+	version, err := statFiles(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if !force && version.equal(r.version) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	r.cert = &cert
+	r.version = version
+	return nil
+}
+
+// certificate returns the current certificate, the files are checked if
+// interval has passed since last check.
+func (r *certReloader) certificate() *tls.Certificate {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checked) >= r.interval {
+		// keep the last good certificate if reloading failed.
+		_ = r.reloadLocked(false)
+	}
+
+	return r.cert
+}
+
+// GetClientCertificate could be used as tls.Config.GetClientCertificate.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// caReloader keeps a CA pool loaded from PEM files, and reloads it when the
+// files are changed, it works in the same way as certReloader.
+type caReloader struct {
+	files    []string
+	interval time.Duration
+
+	mutex   sync.Mutex
+	pool    *x509.CertPool
+	version fileVersion
+	checked time.Time
+}
+
+// newCAReloader loads the CA pool from PEM files.
+func newCAReloader(files ...string) (*caReloader, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no CA file")
+	}
+
+	r := &caReloader{
+		files:    files,
+		interval: _certReloadInterval,
+	}
+	if err := r.reloadLocked(true); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reloadLocked loads the CA pool again if the files have been changed or force
+// is true, r.mutex must be held by caller.
+func (r *caReloader) reloadLocked(force bool) error {
+	r.checked = time.Now()
+
+	version, err := statFiles(r.files...)
+	if err != nil {
+		return err
+	}
+	if !force && version.equal(r.version) {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	for _, file := range r.files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in %s", file)
+		}
+	}
+
+	r.pool = pool
+	r.version = version
+	return nil
+}
+
+// certPool returns the current CA pool, the files are checked if interval has
+// passed since last check.
+func (r *caReloader) certPool() *x509.CertPool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checked) >= r.interval {
+		// keep the last good pool if reloading failed.
+		_ = r.reloadLocked(false)
+	}
+
+	return r.pool
+}
+
+// verifyConnection returns a tls.Config.VerifyConnection which verifies the
+// certificate chain of server with the current CA pool and name, it's used
+// since tls.Config.RootCAs could not be changed once the config is in use.
+// name is the host dialed or the ServerName override, IP hosts are matched
+// with IP SANs. tls.ConnectionState.ServerName could not be used since it's
+// empty for IP hosts, and the verification fails if name is empty.
+func (r *caReloader) verifyConnection(name string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if name == "" {
+			return errors.New("no name to verify the certificate of upstream")
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate presented by upstream")
+		}
+
+		opts := x509.VerifyOptions{
+			DNSName:       name,
+			Roots:         r.certPool(),
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+// verifyName returns the name to verify the certificate of upstream dialed by
+// host, which is host:port or host.
+func verifyName(config *tls.Config, host string) string {
+	if config.ServerName != "" {
+		return config.ServerName
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// buildTLSConfig applies the upstream TLS options onto the global tlsConfig.
+func (o *buildOption) buildTLSConfig() {
+	if o.clientCert == nil && o.rootCAs == nil && !o.insecureSkipVerify {
+		return
+	}
+
+	config := &tls.Config{}
+	if o.tlsConfig != nil {
+		config = o.tlsConfig.Clone()
+	}
+
+	if o.clientCert != nil {
+		config.Certificates = nil
+		config.GetClientCertificate = o.clientCert.GetClientCertificate
+	}
+	if o.rootCAs != nil {
+		// the chain is verified by VerifyConnection with the reloadable pool,
+		// the name is unknown until upstream is created, so it fails closed
+		// until newUpstream replaces it.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = o.rootCAs.verifyConnection("")
+	}
+	if o.insecureSkipVerify {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = nil
+	}
+
+	o.tlsConfig = config
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// _defaultCipherSuites are the cipher suites of TLS 1.2 used by TLSServer as
+// default, only AEAD ciphers with forward secrecy are included. Cipher suites
+// of TLS 1.3 are not configurable.
+var _defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// CertFile is the pair of certificate and key files in PEM.
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+// TLSServer terminates TLS and serves the requests with Handler, such as Router
+// or ReverseProxy. The certificate is chosen by SNI, and the files are reloaded
+// when they're changed, or the process receives SIGHUP if ReloadOnSIGHUP is set.
+type TLSServer struct {
+	// Handler serves the requests.
+	Handler Handler
+	// Certificates to load, the certificate whose DNS names match the SNI is
+	// chosen, exact names are preferred to wildcard names like *.example.com.
+	// The first one is used if none matches.
+	Certificates []CertFile
+	// MinVersion is the minimum TLS version, default is TLS 1.2.
+	MinVersion uint16
+	// CipherSuites are the cipher suites of TLS 1.2, default is the AEAD ciphers
+	// with forward secrecy.
+	CipherSuites []uint16
+	// ReloadInterval is the minimum interval to check whether the files are
+	// changed, default is 10s.
+	ReloadInterval time.Duration
+	// ReloadOnSIGHUP reloads all certificates when the process receives SIGHUP.
+	ReloadOnSIGHUP bool
+	// Server is the underlying fasthttp.Server to configure such as timeouts,
+	// its Handler is replaced by Handler.
+	Server *fasthttp.Server
+	// OnError is called when the certificates could not be reloaded on SIGHUP,
+	// the last good certificates are kept.
+	OnError func(err error)
+
+	mutex     sync.Mutex
+	reloaders []*certReloader
+	done      chan struct{}
+}
+
+// NewTLSServer creates a TLSServer serving requests with handler over TLS.
+func NewTLSServer(handler Handler, certs ...CertFile) *TLSServer {
+	return &TLSServer{
+		Handler:      handler,
+		Certificates: certs,
+	}
+}
+
+// init loads the certificates and starts watching SIGHUP, it's called once.
+func (s *TLSServer) init() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.reloaders != nil {
+		return nil
+	}
+	if s.Handler == nil {
+		return errors.New("handler is nil")
+	}
+	if len(s.Certificates) == 0 {
+		return errors.New("no certificate")
+	}
+
+	interval := s.ReloadInterval
+	if interval <= 0 {
+		interval = _certReloadInterval
+	}
+
+	reloaders := make([]*certReloader, 0, len(s.Certificates))
+	for _, cf := range s.Certificates {
+		r, err := newCertReloader(cf.CertFile, cf.KeyFile)
+		if err != nil {
+			return err
+		}
+		r.interval = interval
+		reloaders = append(reloaders, r)
+	}
+	s.reloaders = reloaders
+
+	if s.Server == nil {
+		s.Server = &fasthttp.Server{}
+	}
+	s.Server.Handler = s.Handler.ServeHTTP
+
+	s.done = make(chan struct{})
+	if s.ReloadOnSIGHUP {
+		go s.watchSignal(s.done)
+	}
+
+	return nil
+}
+
+// watchSignal reloads the certificates when receiving SIGHUP.
+func (s *TLSServer) watchSignal(done <-chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-sig:
+			if err := s.Reload(); err != nil && s.OnError != nil {
+				s.OnError(err)
+			}
+		}
+	}
+}
+
+// Reload loads all certificates from files again, the last good certificate
+// is kept if it could not be loaded.
+func (s *TLSServer) Reload() error {
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, r := range s.reloaders {
+		r.mutex.Lock()
+		if err := r.reloadLocked(true); err != nil {
+			errs = append(errs, err)
+		}
+		r.mutex.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// TLSConfig returns the tls.Config of server, it could be used to serve on a
+// custom listener.
+func (s *TLSServer) TLSConfig() (*tls.Config, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     s.MinVersion,
+		CipherSuites:   s.CipherSuites,
+		GetCertificate: s.getCertificate,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = _defaultCipherSuites
+	}
+
+	return config, nil
+}
+
+// getCertificate chooses the certificate by SNI.
+func (s *TLSServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	var fallback, wildcard *tls.Certificate
+	for _, r := range s.reloaders {
+		cert := r.certificate()
+		if fallback == nil {
+			fallback = cert
+		}
+		if name == "" {
+			break
+		}
+
+		exact, matched := matchCertName(cert, name)
+		if exact {
+			return cert, nil
+		}
+		if matched && wildcard == nil {
+			wildcard = cert
+		}
+	}
+
+	if wildcard != nil {
+		return wildcard, nil
+	}
+	return fallback, nil
+}
+
+// matchCertName reports whether name matches a DNS name of cert exactly, or
+// matches a wildcard name which covers only one label.
+func matchCertName(cert *tls.Certificate, name string) (exact, wildcard bool) {
+	if cert.Leaf == nil {
+		return false, false
+	}
+
+	for _, dnsName := range cert.Leaf.DNSNames {
+		dnsName = strings.ToLower(dnsName)
+		if dnsName == name {
+			return true, true
+		}
+
+		if strings.HasPrefix(dnsName, "*.") {
+			if idx := strings.IndexByte(name, '.'); idx > 0 && name[idx:] == dnsName[1:] {
+				wildcard = true
+			}
+		}
+	}
+
+	return false, wildcard
+}
+
+// ListenAndServe listens on the TCP network address addr and serves over TLS.
+func (s *TLSServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve serves over TLS on ln, it blocks until ln returns permanent error.
+func (s *TLSServer) Serve(ln net.Listener) error {
+	config, err := s.TLSConfig()
+	if err != nil {
+		return err
+	}
+
+	return s.Server.Serve(tls.NewListener(ln, config))
+}
+
+// Shutdown gracefully shuts down the server and stops watching SIGHUP.
+func (s *TLSServer) Shutdown() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.done == nil {
+		return nil
+	}
+	close(s.done)
+	s.done = nil
+
+	return s.Server.Shutdown()
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_matchCertName(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCert(t, dir, "cert", nil, "example.com", "*.example.com").tlsCertificate()
+
+	testCases := []struct {
+		name     string
+		exact    bool
+		wildcard bool
+	}{
+		{name: "example.com", exact: true, wildcard: true},
+		{name: "api.example.com", wildcard: true},
+		{name: "a.b.example.com"},
+		{name: "example.org"},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			exact, wildcard := matchCertName(&cert, tC.name)
+			assert.Equal(t, tC.exact, exact)
+			assert.Equal(t, tC.wildcard, wildcard)
+		})
+	}
+}
+
+func Test_TLSServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	wildcard := newTestCert(t, dir, "wildcard", ca, "*.example.com")
+	api := newTestCert(t, dir, "api", ca, "api.example.com")
+
+	server := NewTLSServer(namedHandler("tls"),
+		CertFile{CertFile: wildcard.certFile, KeyFile: wildcard.keyFile},
+		CertFile{CertFile: api.certFile, KeyFile: api.keyFile},
+	)
+	server.ReloadOnSIGHUP = true
+	reloadErrs := make(chan error, 1)
+	server.OnError = func(err error) { reloadErrs <- err }
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = server.Serve(ln) }()
+	defer func() { assert.Nil(t, server.Shutdown()) }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	handshake := func(serverName string, maxVersion uint16) (*x509.Certificate, error) {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            roots,
+			MaxVersion:         maxVersion,
+			InsecureSkipVerify: serverName == "",
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0], nil
+	}
+
+	testCases := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "api.example.com", want: "api"},
+		{serverName: "www.example.com", want: "wildcard"},
+		{serverName: "", want: "wildcard"},
+	}
+	for _, tC := range testCases {
+		cert, err := handshake(tC.serverName, 0)
+		assert.Nil(t, err)
+		if assert.NotNil(t, cert) {
+			assert.Equal(t, tC.want, cert.Subject.CommonName)
+		}
+	}
+
+	// TLS 1.1 is refused.
+	_, err = handshake("api.example.com", tls.VersionTLS11)
+	assert.NotNil(t, err)
+
+	// requests are served by handler.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "api.example.com"},
+	}}
+	res, err := client.Get("https://" + ln.Addr().String() + "/")
+	if assert.Nil(t, err) {
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.Equal(t, "tls:", string(body))
+	}
+
+	// rotate the certificate and reload on SIGHUP.
+	rotated := newTestCert(t, dir, "api", ca, "api.example.com")
+	process, err := os.FindProcess(os.Getpid())
+	assert.Nil(t, err)
+	assert.Nil(t, process.Signal(syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		cert, err := handshake("api.example.com", 0)
+		return err == nil && cert.SerialNumber.Cmp(rotated.cert.SerialNumber) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the last good certificate is kept if the files are broken.
+	assert.Nil(t, os.WriteFile(api.certFile, []byte("broken"), 0o600))
+	assert.NotNil(t, server.Reload())
+	cert, err := handshake("api.example.com", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, rotated.cert.SerialNumber, cert.SerialNumber)
+	assert.Len(t, reloadErrs, 0)
+}
+
+func Test_TLSServer_Invalid(t *testing.T) {
+	_, err := NewTLSServer(namedHandler("tls")).TLSConfig()
+	assert.NotNil(t, err)
+
+	_, err = NewTLSServer(nil, CertFile{}).TLSConfig()
+	assert.NotNil(t, err)
+
+	_, err = NewTLSServer(namedHandler("tls"), CertFile{CertFile: "missing.crt", KeyFile: "missing.key"}).TLSConfig()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+// testCert is a certificate issued for tests.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// newTestCert issues a certificate for names signed by parent, it's a self-signed
+// CA if parent is nil. The PEM files are written into dir.
+func newTestCert(t *testing.T, dir, name string, parent *testCert, names ...string) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, n)
+		}
+	}
+
+	issuer, signer := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		issuer, signer = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	assert.Nil(t, os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return c
+}
+
+func Test_certReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, dir, "cert", nil, "localhost")
+
+	r, err := newCertReloader(first.certFile, first.keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, first.cert.SerialNumber, r.certificate().Leaf.SerialNumber)
+
+	// not reloaded until interval passed.
+	second := newTestCert(t, dir, "cert", nil, "localhost")
+	assert.Equal(t, first.cert.SerialNumber, r.certificate().Leaf.SerialNumber)
+
+	r.interval = 0
+	assert.Equal(t, second.cert.SerialNumber, r.certificate().Leaf.SerialNumber)
+
+	// the last good certificate is kept.
+	assert.Nil(t, os.WriteFile(second.certFile, []byte("broken"), 0o600))
+	assert.Equal(t, second.cert.SerialNumber, r.certificate().Leaf.SerialNumber)
+
+	_, err = newCertReloader(filepath.Join(dir, "missing.crt"), first.keyFile)
+	assert.NotNil(t, err)
+}
+
+func Test_caReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca, "127.0.0.1")
+
+	r, err := newCAReloader(ca.certFile)
+	assert.Nil(t, err)
+
+	// ServerName of connection is empty for IP hosts, the name dialed is verified.
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{server.cert}}
+	assert.Nil(t, r.verifyConnection("127.0.0.1")(cs))
+	assert.NotNil(t, r.verifyConnection("127.0.0.2")(cs))
+	assert.NotNil(t, r.verifyConnection("example.com")(cs))
+	assert.NotNil(t, r.verifyConnection("")(cs))
+
+	// rotate to another CA, the old chain is not trusted anymore.
+	newTestCert(t, dir, "ca", nil)
+	r.interval = 0
+	assert.NotNil(t, r.verifyConnection("127.0.0.1")(cs))
+
+	_, err = newCAReloader(server.keyFile)
+	assert.NotNil(t, err)
+	_, err = newCAReloader()
+	assert.NotNil(t, err)
+}
+
+func Test_ReverseProxy_WithUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca, "127.0.0.1")
+	client := newTestCert(t, dir, "client", ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	rootCAs := WithUpstreamRootCAs(ca.certFile)
+	clientCert := WithUpstreamClientCert(client.certFile, client.keyFile)
+
+	testCases := []struct {
+		desc    string
+		options []Option
+		status  int
+		body    string
+	}{
+		{desc: "mtls", options: []Option{rootCAs, clientCert}, status: fasthttp.StatusOK, body: "client"},
+		{desc: "no client cert", options: []Option{rootCAs}, status: fasthttp.StatusBadGateway},
+		{desc: "unknown authority", options: []Option{clientCert}, status: fasthttp.StatusBadGateway},
+		{
+			desc:    "insecure skip verify",
+			options: []Option{clientCert, WithUpstreamInsecureSkipVerify()},
+			status:  fasthttp.StatusOK,
+			body:    "client",
+		},
+		{desc: "deprecated WithTLS", options: []Option{rootCAs, WithTLS(client.certFile, client.keyFile)}, status: fasthttp.StatusOK, body: "client"},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			proxy, err := NewReverseProxyWith(append([]Option{WithAddress(upstream.URL)}, tC.options...)...)
+			assert.Nil(t, err)
+			defer proxy.Close()
+
+			ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+			proxy.ServeHTTP(ctx)
+			assert.Equal(t, tC.status, ctx.Response.StatusCode())
+			if tC.body != "" {
+				assert.Equal(t, tC.body, string(ctx.Response.Body()))
+			}
+		})
+	}
+}
+
+func Test_WithTLS_Error(t *testing.T) {
+	assert.NotPanics(t, func() {
+		proxy, err := NewReverseProxyWith(WithAddress("localhost:8443"), WithTLS("missing.crt", "missing.key"))
+		assert.Nil(t, proxy)
+		assert.NotNil(t, err)
+	})
+
+	proxy, err := NewReverseProxyWith(WithAddress("localhost:8443"), WithUpstreamClientCert("missing.crt", "missing.key"))
+	assert.Nil(t, proxy)
+	assert.NotNil(t, err)
+
+	proxy, err = NewReverseProxyWith(WithAddress("localhost:8443"), WithUpstreamRootCAs("missing.crt"))
+	assert.Nil(t, proxy)
+	assert.NotNil(t, err)
+}
+
+func Test_ReverseProxy_WithUpstreamRootCAs_hostname(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	// issued by the trusted CA, but not for the host dialed.
+	evil := newTestCert(t, dir, "evil", ca, "evil.example.com")
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{evil.tlsCertificate()}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	rootCAs := WithUpstreamRootCAs(ca.certFile)
+
+	testCases := []struct {
+		desc   string
+		option Option
+		status int
+	}{
+		{desc: "ip host", option: WithAddress(upstream.URL), status: fasthttp.StatusBadGateway},
+		{
+			desc:   "server name override",
+			option: WithUpstreams(UpstreamConfig{Addr: upstream.URL, ServerName: "evil.example.com"}),
+			status: fasthttp.StatusOK,
+		},
+		{
+			desc:   "wrong server name override",
+			option: WithUpstreams(UpstreamConfig{Addr: upstream.URL, ServerName: "good.example.com"}),
+			status: fasthttp.StatusBadGateway,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			proxy, err := NewReverseProxyWith(tC.option, rootCAs)
+			assert.Nil(t, err)
+			defer proxy.Close()
+
+			ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+			proxy.ServeHTTP(ctx)
+			assert.Equal(t, tC.status, ctx.Response.StatusCode())
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	errUpstreamExists   = errors.New("upstream already exists")
+	errUpstreamNotFound = errors.New("upstream not found")
+)
+
+// upstream wraps fasthttp.HostClient with the states of the upstream server,
+// it implements W so that it could be used by balancer directly.
+type upstream struct {
+	*fasthttp.HostClient
+
+	// name is the address of upstream as configured, it could be host:port
+	// or URL like http://host:port/base, and it identifies the upstream.
+	name string
+	// basePath is the escaped path of URL address, it's joined with the path
+	// of request.
+	basePath string
+
+	// stickyID is the value of affinity cookie, it's set if sticky session is enabled.
+	stickyID string
+
+	// weight of upstream server, it's 1 if balancer is not opened.
+	weight int
+
+	// metadata of upstream server, it's set by Discoverer.
+	metadata map[string]string
+
+	// unhealthy is set by active health checker.
+	unhealthy atomic.Bool
+
+	// ejected is set by passive outlier detection.
+	ejected atomic.Bool
+	// outlier keeps the states of passive outlier detection.
+	outlier outlierState
+
+	// breaker keeps the states of circuit breaker.
+	breaker breakerState
+
+	// p2c keeps the latencies for P2C balancer.
+	p2c p2cNode
+
+	// draining is set when the upstream is removed, it will not be chosen
+	// and would be dropped after in-flight requests finished.
+	draining atomic.Bool
+
+	// inflight is the number of requests being processed by upstream.
+	inflight atomic.Int64
+	// requests is the total number of requests sent to upstream.
+	requests atomic.Uint64
+	// failures is the total number of failed requests, including 5xx responses.
+	failures atomic.Uint64
+}
+
+// UpstreamConfig configures an upstream server individually, such as the
+// scheme and TLS settings, so that upstreams in a balancer group could be
+// different from each other.
+type UpstreamConfig struct {
+	// Addr is host:port or URL like https://10.0.0.5:8443/base, TLS is
+	// enabled if the scheme is https and disabled if it's http. The global
+	// TLS config decides it if there is no scheme.
+	Addr string
+	// Weight of upstream server, 0 is treated as 1.
+	Weight Weight
+	// TLSConfig replaces the global TLS config for this upstream, including
+	// the ones of WithUpstreamRootCAs and WithUpstreamClientCert.
+	TLSConfig *tls.Config
+	// ServerName overrides the SNI and the name to verify the certificate
+	// of upstream, the host of Addr is used if it's empty.
+	ServerName string
+	// RootCAs is the CA pool to verify the certificate of upstream.
+	RootCAs *x509.CertPool
+	// Certificates are the client certificates presented to upstream for mTLS.
+	Certificates []tls.Certificate
+}
+
+// tlsConfig builds the TLS config of upstream from the global one and cfg.
+func (cfg *UpstreamConfig) tlsConfig(global *tls.Config) *tls.Config {
+	base := global
+	if cfg != nil && cfg.TLSConfig != nil {
+		base = cfg.TLSConfig
+	}
+	if cfg == nil || (cfg.ServerName == "" && cfg.RootCAs == nil && len(cfg.Certificates) == 0) {
+		return base
+	}
+
+	var config *tls.Config
+	if base != nil {
+		config = base.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if cfg.ServerName != "" {
+		config.ServerName = cfg.ServerName
+	}
+	if cfg.RootCAs != nil {
+		config.RootCAs = cfg.RootCAs
+	}
+	if len(cfg.Certificates) != 0 {
+		config.Certificates = cfg.Certificates
+	}
+
+	return config
+}
+
+// newUpstream creates an upstream with HostClient configured by opt.
+func newUpstream(addr string, weight int, opt *buildOption) (*upstream, error) {
+	host, scheme, basePath, err := parseUpstreamAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := opt.upstreamConfigs[addr]
+	tlsConfig := cfg.tlsConfig(opt.tlsConfig)
+
+	var isTLS bool
+	switch scheme {
+	case "https":
+		isTLS = true
+	case "http":
+		isTLS = false
+	default:
+		isTLS = tlsConfig != nil
+	}
+	if !isTLS {
+		tlsConfig = nil
+	} else if opt.rootCAs != nil && !opt.insecureSkipVerify && (cfg == nil || cfg.TLSConfig == nil) {
+		// verify the certificate with the host dialed.
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.VerifyConnection = opt.rootCAs.verifyConnection(verifyName(tlsConfig, host))
+	}
+
+	u := &upstream{
+		HostClient: &fasthttp.HostClient{
+			Addr:                   host,
+			Name:                   _fasthttpHostClientName,
+			IsTLS:                  isTLS,
+			TLSConfig:              tlsConfig,
+			DisablePathNormalizing: opt.disablePathNormalizing,
+			MaxResponseBodySize:    opt.maxResponseBodySize,
+			StreamResponseBody:     opt.streamResponseBody,
+			MaxConnDuration:        opt.maxConnDuration,
+		},
+		name:     addr,
+		basePath: basePath,
+		weight:   weight,
+	}
+	if opt.stickySession != nil {
+		u.stickyID = opt.stickySession.stickyID(addr)
+	}
+
+	return u, nil
+}
+
+// parseUpstreamAddr parses addr which is host:port or URL like http://host:port/base,
+// the URL is parsed in the same way as the target of WSReverseProxy. scheme is
+// empty if addr is not URL.
+func parseUpstreamAddr(addr string) (host, scheme, basePath string, err error) {
+	if !strings.Contains(addr, "://") {
+		return addr, "", "", nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", "", fmt.Errorf("unsupported scheme of upstream %s", addr)
+	}
+	if u.Host == "" {
+		return "", "", "", fmt.Errorf("no host in upstream %s", addr)
+	}
+
+	return u.Host, u.Scheme, u.EscapedPath(), nil
+}
+
+// Weight implements W.
+func (u *upstream) Weight() int {
+	return u.weight
+}
+
+// Inflight implements InflightW.
+func (u *upstream) Inflight() int64 {
+	return u.inflight.Load()
+}
+
+// p2cNode implements p2cW.
+func (u *upstream) p2cNode() *p2cNode {
+	return &u.p2c
+}
+
+// String returns the address of upstream as configured.
+func (u *upstream) String() string {
+	return u.name
+}
+
+// available reports whether the upstream could be chosen by balancer.
+func (u *upstream) available() bool {
+	return !u.unhealthy.Load() && !u.ejected.Load() && !u.draining.Load()
+}
+
+// UpstreamStats is the snapshot of an upstream's states and statistics.
+type UpstreamStats struct {
+	// Addr of upstream server.
+	Addr string
+	// Weight of upstream server.
+	Weight int
+	// Healthy is false if the upstream failed active health checking.
+	Healthy bool
+	// Ejected is true if the upstream is ejected by passive outlier detection.
+	Ejected bool
+	// Draining is true if the upstream has been removed and is waiting
+	// for in-flight requests to finish.
+	Draining bool
+	// Inflight is the number of requests being processed.
+	Inflight int64
+	// Requests is the total number of requests sent to upstream.
+	Requests uint64
+	// Failures is the total number of failed requests, including 5xx responses.
+	Failures uint64
+	// Metadata of upstream server, it's set by Discoverer.
+	Metadata map[string]string
+	// Breaker is the state of circuit breaker, it's always closed if circuit
+	// breaker is not enabled.
+	Breaker BreakerState
+}
+
+func (u *upstream) stats() UpstreamStats {
+	return UpstreamStats{
+		Addr:     u.name,
+		Weight:   u.weight,
+		Healthy:  !u.unhealthy.Load(),
+		Ejected:  u.ejected.Load(),
+		Draining: u.draining.Load(),
+		Inflight: u.inflight.Load(),
+		Requests: u.requests.Load(),
+		Failures: u.failures.Load(),
+		Metadata: u.metadata,
+		Breaker:  u.breaker.current(),
+	}
+}
+
+// Upstreams returns the stats of all upstreams, including draining ones.
+func (p *ReverseProxy) Upstreams() []UpstreamStats {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	stats := make([]UpstreamStats, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		stats = append(stats, u.stats())
+	}
+
+	return stats
+}
+
+// findUpstream finds the upstream by addr, p.mutex must be held by caller.
+func (p *ReverseProxy) findUpstream(addr string) *upstream {
+	for _, u := range p.upstreams {
+		if u.name == addr {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// AddUpstream adds an upstream server to ReverseProxy at runtime, it's safe
+// to be called concurrently. A draining upstream would be brought back.
+func (p *ReverseProxy) AddUpstream(addr string, weight W) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if u := p.findUpstream(addr); u != nil {
+		if !u.draining.Load() {
+			return errUpstreamExists
+		}
+		u.weight = weight.Weight()
+		u.draining.Store(false)
+	} else {
+		u, err := newUpstream(addr, weight.Weight(), p.opt)
+		if err != nil {
+			return err
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	p.rebuild()
+	return nil
+}
+
+// RemoveUpstream removes an upstream server from ReverseProxy at runtime, it's
+// safe to be called concurrently. The upstream would not be chosen anymore, and
+// it would be dropped after in-flight requests finished.
+func (p *ReverseProxy) RemoveUpstream(addr string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	u := p.findUpstream(addr)
+	if u == nil || u.draining.Load() {
+		return errUpstreamNotFound
+	}
+
+	u.draining.Store(true)
+	p.rebuild()
+
+	p.wg.Add(1)
+	go p.drain(u)
+	return nil
+}
+
+// SetUpstreamWeight changes the weight of an upstream server at runtime, it's
+// safe to be called concurrently.
+func (p *ReverseProxy) SetUpstreamWeight(addr string, weight W) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	u := p.findUpstream(addr)
+	if u == nil || u.draining.Load() {
+		return errUpstreamNotFound
+	}
+
+	u.weight = weight.Weight()
+	p.rebuild()
+	return nil
+}
+
+// drain waits for in-flight requests of u to finish, and then drops it.
+func (p *ReverseProxy) drain(u *upstream) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for u.inflight.Load() > 0 {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !u.draining.Load() {
+			// added back
+			return
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !u.draining.Load() {
+		return
+	}
+
+	for idx, up := range p.upstreams {
+		if up == u {
+			p.upstreams = append(p.upstreams[:idx:idx], p.upstreams[idx+1:]...)
+			break
+		}
+	}
+	u.CloseIdleConnections()
+	debugF(p.opt.debug, p.opt.logger, "upstream %s has been drained and removed", u.name)
+}
+
+// SetUpstreams replaces the upstream set of ReverseProxy with targets at runtime,
+// it's safe to be called concurrently. New targets are added, existing ones are
+// updated, and upstreams not in targets are removed after draining.
+func (p *ReverseProxy) SetUpstreams(targets []Target) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	wanted := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		u := p.findUpstream(target.Addr)
+		if u == nil {
+			var err error
+			if u, err = newUpstream(target.Addr, target.weight(), p.opt); err != nil {
+				errorF(p.opt.logger, "could not add upstream %s, err = %v", target.Addr, err)
+				continue
+			}
+			p.upstreams = append(p.upstreams, u)
+		}
+		wanted[target.Addr] = struct{}{}
+		u.weight = target.weight()
+		u.metadata = target.Metadata
+		u.draining.Store(false)
+	}
+
+	for _, u := range p.upstreams {
+		if _, ok := wanted[u.name]; ok || u.draining.Load() {
+			continue
+		}
+
+		u.draining.Store(true)
+		p.wg.Add(1)
+		go p.drain(u)
+	}
+
+	p.rebuild()
+}
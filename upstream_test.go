@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func findStats(stats []UpstreamStats, addr string) *UpstreamStats {
+	for idx := range stats {
+		if stats[idx].Addr == addr {
+			return &stats[idx]
+		}
+	}
+
+	return nil
+}
+
+func Test_ReverseProxy_AddUpstream(t *testing.T) {
+	addr1 := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("1") })
+	addr2 := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("2") })
+
+	proxy, err := NewReverseProxyWith(WithAddress(addr1))
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	assert.Nil(t, proxy.AddUpstream(addr2, Weight(1)))
+	assert.Equal(t, errUpstreamExists, proxy.AddUpstream(addr2, Weight(1)))
+
+	count := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		count[string(ctx.Response.Body())]++
+	}
+	assert.Equal(t, 5, count["1"])
+	assert.Equal(t, 5, count["2"])
+
+	stats := proxy.Upstreams()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, uint64(5), findStats(stats, addr2).Requests)
+	assert.Zero(t, findStats(stats, addr2).Inflight)
+	assert.True(t, findStats(stats, addr2).Healthy)
+}
+
+func Test_ReverseProxy_SetUpstreamWeight(t *testing.T) {
+	addr1 := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("1") })
+	addr2 := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("2") })
+
+	proxy, err := NewReverseProxyWith(WithBalancer(map[string]Weight{addr1: 1, addr2: 1}))
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	assert.Nil(t, proxy.SetUpstreamWeight(addr2, Weight(0)))
+	assert.Equal(t, errUpstreamNotFound, proxy.SetUpstreamWeight("unknown:80", Weight(1)))
+
+	for i := 0; i < 10; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		assert.Equal(t, "1", string(ctx.Response.Body()))
+	}
+	assert.Equal(t, 0, findStats(proxy.Upstreams(), addr2).Weight)
+}
+
+func Test_ReverseProxy_RemoveUpstream(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+		once    sync.Once
+	)
+	slowAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		once.Do(func() { close(entered) })
+		<-release
+		ctx.SetBodyString("slow")
+	})
+	fastAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("fast") })
+
+	proxy, err := NewReverseProxyWith(WithAddress(slowAddr))
+	assert.Nil(t, err)
+	defer proxy.Close()
+	assert.Nil(t, proxy.AddUpstream(fastAddr, Weight(1)))
+	assert.Nil(t, proxy.SetUpstreamWeight(fastAddr, Weight(0)))
+
+	// hold a request in-flight on slow upstream.
+	done := make(chan string)
+	go func() {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		done <- string(ctx.Response.Body())
+	}()
+	<-entered
+
+	assert.Nil(t, proxy.RemoveUpstream(slowAddr))
+	assert.Equal(t, errUpstreamNotFound, proxy.RemoveUpstream(slowAddr))
+
+	// new requests go to the other one.
+	ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+	proxy.ServeHTTP(ctx)
+	assert.Equal(t, "fast", string(ctx.Response.Body()))
+
+	// slow upstream keeps draining until the in-flight request finished.
+	time.Sleep(30 * time.Millisecond)
+	stats := findStats(proxy.Upstreams(), slowAddr)
+	if assert.NotNil(t, stats) {
+		assert.True(t, stats.Draining)
+		assert.Equal(t, int64(1), stats.Inflight)
+	}
+
+	close(release)
+	assert.Equal(t, "slow", <-done)
+	assert.Eventually(t, func() bool {
+		return findStats(proxy.Upstreams(), slowAddr) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_parseUpstreamAddr(t *testing.T) {
+	testCases := []struct {
+		addr     string
+		host     string
+		scheme   string
+		basePath string
+		wantErr  bool
+	}{
+		{addr: "localhost:8080", host: "localhost:8080"},
+		{addr: "http://localhost:8080", host: "localhost:8080", scheme: "http"},
+		{addr: "https://10.0.0.5:8443/base/", host: "10.0.0.5:8443", scheme: "https", basePath: "/base/"},
+		{addr: "http://localhost/a%2Fb", host: "localhost", scheme: "http", basePath: "/a%2Fb"},
+		{addr: "ftp://localhost", wantErr: true},
+		{addr: "http:///base", wantErr: true},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.addr, func(t *testing.T) {
+			host, scheme, basePath, err := parseUpstreamAddr(tC.addr)
+			if tC.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tC.host, host)
+			assert.Equal(t, tC.scheme, scheme)
+			assert.Equal(t, tC.basePath, basePath)
+		})
+	}
+}
+
+func Test_newUpstream_TLS(t *testing.T) {
+	global := &tls.Config{ServerName: "global.local"}
+	pool := x509.NewCertPool()
+
+	testCases := []struct {
+		desc       string
+		addr       string
+		global     *tls.Config
+		cfg        *UpstreamConfig
+		isTLS      bool
+		serverName string
+	}{
+		{desc: "plain", addr: "localhost:8080"},
+		{desc: "global", addr: "localhost:8443", global: global, isTLS: true, serverName: "global.local"},
+		{desc: "https scheme", addr: "https://localhost:8443", isTLS: true},
+		{desc: "http scheme overrides global", addr: "http://localhost:8080", global: global},
+		{
+			desc:       "sni override",
+			addr:       "https://10.0.0.5:8443",
+			global:     global,
+			cfg:        &UpstreamConfig{ServerName: "backend.local", RootCAs: pool},
+			isTLS:      true,
+			serverName: "backend.local",
+		},
+		{
+			desc:       "own config",
+			addr:       "https://10.0.0.5:8443",
+			global:     global,
+			cfg:        &UpstreamConfig{TLSConfig: &tls.Config{ServerName: "own.local"}},
+			isTLS:      true,
+			serverName: "own.local",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			opt := defaultBuildOption()
+			opt.tlsConfig = tC.global
+			if tC.cfg != nil {
+				tC.cfg.Addr = tC.addr
+				opt.upstreamConfigs = map[string]*UpstreamConfig{tC.addr: tC.cfg}
+			}
+
+			u, err := newUpstream(tC.addr, 1, opt)
+			assert.Nil(t, err)
+			assert.Equal(t, tC.isTLS, u.IsTLS)
+			if !tC.isTLS {
+				assert.Nil(t, u.TLSConfig)
+				return
+			}
+			if tC.serverName != "" {
+				assert.Equal(t, tC.serverName, u.TLSConfig.ServerName)
+			}
+			if tC.cfg != nil && tC.cfg.RootCAs != nil {
+				assert.Equal(t, tC.cfg.RootCAs, u.TLSConfig.RootCAs)
+			}
+		})
+	}
+
+	// the global config is not modified.
+	assert.Equal(t, "global.local", global.ServerName)
+	assert.Nil(t, global.RootCAs)
+}
+
+func Test_ReverseProxy_WithUpstreams(t *testing.T) {
+	plainAddr := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("plain")
+	})
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tls"))
+	}))
+	defer tlsServer.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsServer.Certificate())
+
+	proxy, err := NewReverseProxyWith(WithUpstreams(
+		UpstreamConfig{Addr: "http://" + plainAddr},
+		UpstreamConfig{Addr: tlsServer.URL, ServerName: "example.com", RootCAs: pool},
+	))
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	bodies := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		ctx := newTestRequestCtx(fasthttp.MethodGet, "http://example.com/")
+		proxy.ServeHTTP(ctx)
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+		bodies[string(ctx.Response.Body())]++
+	}
+	assert.Equal(t, map[string]int{"plain": 2, "tls": 2}, bodies)
+}